@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jasonaaronwilson/omni-archive/src/go/corearchive"
+)
+
+// The flags of the cat command.
+type cat_options struct {
+	// The range of each member's (decompressed) data to write
+	// (length is -1 for everything after offset).
+	offset int64
+	length int64
+	// Written between members.
+	separator string
+}
+
+func parse_cat_options(flags map[string]string) (cat_options, error) {
+	options := cat_options{length: -1}
+	for _, flag := range []struct {
+		name  string
+		value *int64
+	}{{"offset", &options.offset}, {"length", &options.length}} {
+		text, ok := flags[flag.name]
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseInt(text, 0, 64)
+		if err != nil || value < 0 {
+			return options, usage_error(fmt.Sprintf("bad --%s %s", flag.name, text))
+		}
+		*flag.value = value
+	}
+	if text, ok := flags["separator"]; ok {
+		separator, err := unescape(text)
+		if err != nil {
+			return options, usage_error(fmt.Sprintf("bad --separator %q", text))
+		}
+		options.separator = separator
+	}
+	return options, nil
+}
+
+// This command writes the data of the matching members (decompressed
+// when necessary) to stdout in the order they are in the archive.
+// A hard link writes the data of the first member before it with the
+// name it links to while members without any data (like directories
+// and symbolic links) are skipped.
+func cat_command(flags map[string]string, patterns []string) error {
+	options, err := parse_cat_options(flags)
+	if err != nil {
+		return err
+	}
+	selector, err := new_member_selector(flags, patterns)
+	if err != nil {
+		return err
+	}
+	return with_input_archive(flags,
+		func(archive *corearchive.Reader) error {
+			if err := selector.check_patterns(archive); err != nil {
+				return err
+			}
+			archive.PlanReads(selector.matches, true)
+			output := bufio.NewWriter(os.Stdout)
+			first := true
+			// The first member with each name (which is what a
+			// hard link is a link to) so an archive read from a
+			// pipe is only gone through once.
+			by_name := make(map[string]corearchive.Header)
+			for header, err := range archive.All() {
+				if err != nil {
+					return err
+				}
+				name, ok := header[corearchive.FILE_NAME_KEY]
+				if _, seen := by_name[name]; ok && !seen {
+					by_name[name] = header
+				}
+				if !selector.matches(header) {
+					continue
+				}
+				if header.FileType() == corearchive.FILE_TYPE_HARD_LINK {
+					target, ok := by_name[header[corearchive.LINK_TARGET_KEY]]
+					if !ok {
+						return &corearchive.ArchiveError{
+							Archive: archive.Name(),
+							Member:  header[corearchive.LINK_TARGET_KEY],
+							Offset:  -1,
+							Err:     corearchive.ErrMemberNotFound,
+						}
+					}
+					header = target
+				}
+				if header.FileType() != corearchive.FILE_TYPE_REGULAR {
+					continue
+				}
+				if !first {
+					output.WriteString(options.separator)
+				}
+				first = false
+				if err := cat_member(output, archive, header, options); err != nil {
+					return err
+				}
+			}
+			return output.Flush()
+		})
+}
+
+// Write the part of a member's data that --offset and --length ask
+// for. Data that isn't compressed is read starting at offset but
+// compressed data has to be decompressed from the beginning.
+func cat_member(output io.Writer, archive *corearchive.Reader, header corearchive.Header, options cat_options) error {
+	var contents io.Reader
+	if !header.IsCompressed() {
+		data, err := archive.Data(header)
+		if err != nil {
+			return err
+		}
+		length := data.Size() - min(options.offset, data.Size())
+		if options.length >= 0 {
+			length = min(length, options.length)
+		}
+		contents = io.NewSectionReader(data, options.offset, length)
+	} else {
+		decompressed, err := archive.Open(header)
+		if err != nil {
+			return err
+		}
+		defer decompressed.Close()
+		if _, err := io.CopyN(io.Discard, decompressed, options.offset); err != nil && err != io.EOF {
+			return with_member(archive, header, err)
+		}
+		contents = decompressed
+		if options.length >= 0 {
+			contents = io.LimitReader(decompressed, options.length)
+		}
+	}
+	if _, err := io.Copy(output, contents); err != nil {
+		return with_member(archive, header, err)
+	}
+	return nil
+}
+
+// Replace the escapes a C or Go string may have (like "\n", "\t", or
+// "\x00") with the characters they stand for. "\0" is a NUL byte.
+func unescape(text string) (string, error) {
+	result := strings.Builder{}
+	for text != "" {
+		if strings.HasPrefix(text, `\0`) && (len(text) == 2 || text[2] < '0' || text[2] > '7') {
+			result.WriteByte(0)
+			text = text[2:]
+			continue
+		}
+		value, multibyte, rest, err := strconv.UnquoteChar(text, 0)
+		if err != nil {
+			return "", err
+		}
+		if multibyte {
+			result.WriteRune(value)
+		} else {
+			result.WriteByte(byte(value))
+		}
+		text = rest
+	}
+	return result.String(), nil
+}
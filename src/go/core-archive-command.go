@@ -1,48 +1,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
 	"os"
 	"path/filepath"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
-)
-
-// These are the only keys we can explicitly read and write though
-// when appending archives, we preserve all of the key/value pairs
-// even if they are not known.
-const (
-	FILE_NAME_KEY = "file-name:"
-	SIZE_KEY      = "size:"
-	START_KEY     = "start:"
-)
 
-// These are additional "known keys" from the spec
-const (
-	ALIGN_KEY                           = "align:"
-	DATA_COMPRESSION_ALGORITHM_KEY      = "data-compression-algorithm:"
-	DATA_HASH_ALGORITHM_KEY             = "data-hash-algorithm:"
-	DATA_HASH_KEY                       = "data-hash:"
-	DATA_SIZE_KEY                       = "data-size:"
-	EXTERNAL_FILE_NAME_KEY              = "external-file-name:"
-	FILE_VERSION_KEY                    = "file-version:"
-	FOR_FILE_NAME_KEY                   = "for-file-name:"
-	METADATA_NAME_KEY                   = "metadata-name:"
-	MIME_VERSION_KEY                    = "mime-version:"
-	POSIX_FILE_MODE_KEY                 = "posix-file-mode:"
-	POSIX_GROUP_NAME_KEY                = "posix-group-name:"
-	POSIX_GROUP_NUMBER_KEY              = "posix-group-number:"
-	POSIX_MODIFICATION_TIME_NANOS_KEY   = "posix-modification-time-nanos:"
-	POSIX_MODIFICATION_TIME_SECONDS_KEY = "posix-modification-time-seconds:"
-	POSIX_OWNER_NAME_KEY                = "posix-owner-name:"
-	POSIX_OWNER_NUMBER_KEY              = "posix-owner-number:"
-)
-
-// Application specific keys are prefixed with "x-".
-const (
-	USER_DEFINED_KEY_PREFIX = "x-"
+	"github.com/jasonaaronwilson/omni-archive/src/go/corearchive"
 )
 
 var verbosity uint = 0
@@ -53,734 +23,494 @@ const (
 	VERBOSITY_INFO    = 2
 )
 
-// The copy_bytes_to_output achieves *massive* speedups by reading and
-// writing in chunks instead of one byte at a time. Since we don't try
-// to reuse the allocated buffer (and for other reasons), for now we
-// are just keeping this at a reasonable size. For testing, I
-// sometimes set this to 3 (it would actually be cool to set this from
-// the command line).
-const (
-	BUFFER_SIZE = 8192
-)
-
-// This represents both IO sources and IO targets.
-type IOInfo struct {
-	// Only one of filename or file should be set
-	filename string
-	file     *os.File
-
-	// A value of zero means do not perform a seek before reading
-	seek_offset int64
+// The values of --verbosity (in the same order as the constants).
+var verbosity_levels = []string{"error", "warning", "info"}
 
-	// For an input, this tells us how many bytes to expect. For
-	// an output, it has no meaning and should be left zero
-	size int64
-}
-
-//
-// Read all headers and display the file names contained in a very
-// succinct format.
-//
-func list_command(args []string) {
-	for _, archive_name := range args {
-		with_archive(
-			archive_name,
-			func(archive *os.File) {
-				headers := read_headers(archive)
-				for _, header := range headers {
-					if has_key(header, FILE_NAME_KEY) {
-						fmt.Println(header[FILE_NAME_KEY])
-					}
-				}
-			})
+// Log a line about what is being done to stderr when the verbosity is
+// at least level (so VERBOSITY_ERROR lines are always shown).
+func log_line(level uint, format string, args ...any) {
+	if verbosity >= level {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
 	}
 }
 
-//
-// Read all headers and then display them in a human readable format
-//
-func headers_command(args []string) {
-	for _, archive_name := range args {
-		with_archive(
-			archive_name,
-			func(archive *os.File) {
-				headers := read_headers(archive)
-				for _, header := range headers {
-					fmt.Println(header_to_string(header))
-				}
-			})
-	}
-}
-
-//
-// This command appends one or more archives.
-//
-func append_command(args []string) {
-	archive_name := args[0]
-	archives := args[1:]
-
-	headers := []map[string]string{}
-	inputs := []IOInfo{}
-	to_close := []*os.File{}
-
-	for _, input_archive_name := range archives {
-		archive, err := os.Open(input_archive_name)
-		if err != nil {
-			panic(err)
-		}
-		to_close = append(to_close, archive)
-		more_headers := read_headers(archive)
-		for _, header := range more_headers {
-			// TODO(jawilson): we can have a header with zero size...
-			// if has_key(header, FILE_NAME_KEY) {
-			// }
-			headers = append(headers, header)
-			inputs = append(inputs,
-				IOInfo{
-					file:        archive,
-					seek_offset: as_int64(header[START_KEY]),
-					size:        as_int64(header[SIZE_KEY]),
-				})
-		}
-	}
-
-	write_archive(archive_name, headers, inputs)
-
+// This command writes the members of one or more archives to a new
+// archive (so it is like cat(1) except that the new archive has a
+// single header region).
+func join_command(flags map[string]string, archives []string) error {
+	to_close := []*corearchive.Reader{}
 	// Close all of the archives we've opened
-	for _, openFile := range to_close {
-		if err := openFile.Close(); err != nil {
-			panic(err)
+	defer func() {
+		for _, archive := range to_close {
+			archive.Close()
 		}
-	}
-}
-
-//
-// This command creates an archive based on the command line
-// arguments.
-//
-func create_command(args []string) {
-	archive_name := args[0]
-	files := args[1:]
-
-	headers := []map[string]string{}
-	inputs := []IOInfo{}
+	}()
 
-	for _, root := range files {
-		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+	return write_archive(output_archive_name(flags), func(writer *corearchive.Writer) error {
+		if err := set_writer_options(writer, flags); err != nil {
+			return err
+		}
+		for _, input_archive_name := range archives {
+			archive, err := open_archive(input_archive_name)
 			if err != nil {
-				panic(err)
+				return err
 			}
-			if info.IsDir() {
-				return nil
+			to_close = append(to_close, archive)
+			if err := add_members(writer, archive, flags); err != nil {
+				return err
 			}
-			if verbosity >= VERBOSITY_INFO {
-				fmt.Println("Adding " + path)
+		}
+		return nil
+	})
+}
+
+// Add every member of an archive to the archive being written. With
+// --hash or --compress, the Writer reads the data of members more
+// than once so the data of an archive read from a pipe is copied to
+// the Writer's spool file (in a single pass) instead.
+func add_members(writer *corearchive.Writer, archive *corearchive.Reader, flags map[string]string) error {
+	_, hash := flags["hash"]
+	_, compress := flags["compress"]
+	spool := archive.IsStream() && (hash || compress)
+	for header, err := range archive.All() {
+		// TODO(jawilson): we can have a header with zero size...
+		// if header.Has(corearchive.FILE_NAME_KEY) {
+		// }
+		if err != nil {
+			return err
+		}
+		data, err := archive.Data(header)
+		if err != nil {
+			return err
+		}
+		if !spool {
+			if err := writer.AddSection(header, data); err != nil {
+				return err
 			}
-
-			header := make(map[string]string)
-			header[FILE_NAME_KEY] = make_path_relative_if_absolute(path)
-			header[SIZE_KEY] = fmt.Sprintf("%x", info.Size())
-
-			headers = append(headers, header)
-			inputs = append(inputs,
-				IOInfo{
-					filename: path,
-					size:     info.Size(),
-				})
-			return nil
-		})
+			continue
+		}
+		member, err := writer.CreateMember(maps.Clone(header))
 		if err != nil {
-			panic(err)
+			return err
 		}
-	}
-
-	write_archive(archive_name, headers, inputs)
-}
-
-func make_path_relative_if_absolute(path string) string {
-	if strings.HasPrefix(path, "/") {
-		asRunes := []rune(path)
-		if len(asRunes) == 1 {
-			panic("Removed the only character '/' for a path")
+		if _, err := io.Copy(member, data); err != nil {
+			return with_member(archive, header, err)
 		}
-		return string(asRunes[1:])
 	}
-	return path
+	return nil
 }
 
-//
-// This command allows the removal of some members from an archive
-//
-func remove_by_filename_command(args []string) {
-	output_archive_name := args[0]
-	input_archive_name := args[1]
-	to_remove_names := args[2:]
-	to_remove_map := make(map[string]bool)
-	for _, name := range to_remove_names {
-		to_remove_map[name] = true
-	}
-
-	headers := []map[string]string{}
-	inputs := []IOInfo{}
-	to_close := []*os.File{}
-
-	archive, err := os.Open(input_archive_name)
+// This command creates an archive based on the command line
+// arguments. With --jobs, files are looked at (and their data is
+// hashed and compressed) several at a time but the archive is always
+// the same.
+func create_command(flags map[string]string, files []string) error {
+	add, err := parse_add_files(flags)
 	if err != nil {
-		panic(err)
-	}
-	to_close = append(to_close, archive)
-	more_headers := read_headers(archive)
-	for _, header := range more_headers {
-		if to_remove_map[header[FILE_NAME_KEY]] {
-			continue
-		}
-		headers = append(headers, header)
-		inputs = append(inputs,
-			IOInfo{
-				file:        archive,
-				seek_offset: as_int64(header[START_KEY]),
-				size:        as_int64(header[SIZE_KEY]),
-			})
+		return err
 	}
-
-	write_archive(output_archive_name, headers, inputs)
-
-	// Close all of the archives we've opened
-	for _, openFile := range to_close {
-		if err := openFile.Close(); err != nil {
-			panic(err)
+	return write_archive(output_archive_name(flags), func(writer *corearchive.Writer) error {
+		if err := set_writer_options(writer, flags); err != nil {
+			return err
 		}
-	}
+		return add(writer, files)
+	})
 }
 
-// Only extract *files* explicitly requested on the command
-// line. (Since shells and POSIX style filenames (unless explicitly
-// ending in say "/") it's hard to tell directories from files to
-// infer intent).
-//
-// TODO(jawilson): it looks like this can use
-// extract_files_by_predicate shortly.
-func extract_by_file_name_command(args []string) {
-	archive_name := args[0]
-	files := args[1:]
-
-	with_archive(archive_name,
-		func(archive *os.File) {
-
-			headers := read_headers(archive)
-
-			// Now extract each file
-
-			// TODO(jawilson): organize headers into a map
-			// of headers off the key FILE_NAME_KEY so
-			// this isn't O(N^2) where N is the number of
-			// headers
-
-			for _, filename := range files {
-				header := find_header(headers, filename)
-				if header == nil {
-					panic("File not found in archive: " + filename)
-				}
-				copy_bytes(
-					IOInfo{
-						filename: filename,
-					},
-					IOInfo{
-						file:        archive,
-						seek_offset: as_int64(header[START_KEY]),
-						size:        as_int64(header[SIZE_KEY]),
-					})
+// This command copies the archive given by --input-file (or stdin)
+// and adds files to it just like create does.
+func append_command(flags map[string]string, files []string) error {
+	if len(files) < 1 {
+		return usage_error("append needs the files to add")
+	}
+	add, err := parse_add_files(flags)
+	if err != nil {
+		return err
+	}
+	return with_input_archive(flags, func(archive *corearchive.Reader) error {
+		return write_archive(output_archive_name(flags), func(writer *corearchive.Writer) error {
+			if err := set_writer_options(writer, flags); err != nil {
+				return err
 			}
+			if err := add_members(writer, archive, flags); err != nil {
+				return err
+			}
+			return add(writer, files)
 		})
+	})
 }
 
-func extract_command(args []string) {
-	extract_files_by_predicate(args,
-		func(header map[string]string) bool {
-			return has_key(header, FILE_NAME_KEY)
-		})
-}
-
-func extract_files_by_predicate(args []string, predicate func(map[string]string) bool) {
-	for _, archive_name := range args {
-		with_archive(archive_name,
-			func(archive *os.File) {
-				headers := read_headers(archive)
-				for _, header := range headers {
-					if predicate(header) {
-						copy_bytes(
-							IOInfo{
-								filename: header[FILE_NAME_KEY],
-							},
-							IOInfo{
-								file:        archive,
-								seek_offset: as_int64(header[START_KEY]),
-								size:        as_int64(header[SIZE_KEY]),
-							})
-					}
-				}
-			})
+// Handle the --transform, --jobs, and --exclude flags of create and
+// append. Returns a function that adds files (and everything in
+// directories) to an archive.
+func parse_add_files(flags map[string]string) (func(*corearchive.Writer, []string) error, error) {
+	transformer, err := parse_name_transformer(flags)
+	if err != nil {
+		return nil, err
 	}
-}
-
-// Call a handler function with the open file representing the named
-// archive. The file is automatically closed when the handler returns
-func with_archive(archive_name string, handler func(*os.File)) {
-	archive, err := os.Open(archive_name)
+	jobs, err := parse_jobs(flags)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	handler(archive)
-	if err := archive.Close(); err != nil {
-		panic(err)
+	// Only --exclude applies to files being added.
+	selector, err := new_member_selector(flags, nil)
+	if err != nil {
+		return nil, err
+	}
+	return func(writer *corearchive.Writer, files []string) error {
+		writer.SetJobs(jobs)
+		adder := new_file_adder(writer, jobs)
+		defer adder.stop()
+		for _, root := range files {
+			// WalkDir (like Walk) never follows symbolic
+			// links but also gives us the result of lstat()
+			// so we can tell what each file really is.
+			err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					// The files found before this one
+					// come first.
+					if finish_err := adder.finish(); finish_err != nil {
+						return finish_err
+					}
+					return err
+				}
+				name := make_path_relative_if_absolute(path)
+				if name == "" || name == "." {
+					return nil
+				}
+				if selector.excluded(name) {
+					if entry.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				name, ok := transformer.transform(name)
+				if !ok {
+					return nil
+				}
+				return adder.add(path, name, entry)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return adder.finish()
+	}, nil
+}
+
+// Add a single file of any type (with the target of a symbolic link
+// already read) to an archive. Only regular files have any data
+// (which is only stored once for files with several hard links).
+func add_file(writer *corearchive.Writer, path string, name string, info fs.FileInfo, link string, hard_links map[file_identity]string) error {
+	header := corearchive.FileInfoHeader(info, name, link)
+	if info.Mode().IsRegular() {
+		identity, has_links := hard_link_identity(info)
+		first, seen := hard_links[identity]
+		if !has_links || !seen {
+			if has_links {
+				hard_links[identity] = name
+			}
+			return writer.AddFile(header, path)
+		}
+		header[corearchive.FILE_TYPE_KEY] = corearchive.FILE_TYPE_HARD_LINK
+		header[corearchive.LINK_TARGET_KEY] = first
+		header[corearchive.SIZE_KEY] = "0"
 	}
+	_, err := writer.CreateMember(header)
+	return err
 }
 
-// Find the header for a paritcular file. Does not yet handle
-// versioned files.
-func find_header(headers []map[string]string, filename string) map[string]string {
-	for _, header := range headers {
-		if header[FILE_NAME_KEY] == filename {
-			return header
+// Handle the --hash, --compress, and --align flags of create, append,
+// and join.
+func set_writer_options(writer *corearchive.Writer, flags map[string]string) error {
+	if algorithm, ok := flags["hash"]; ok {
+		if err := writer.SetHashAlgorithm(algorithm); err != nil {
+			return usage_error(err.Error())
 		}
 	}
-	return nil
-}
-
-//
-// Assign START_KEY values to all members with non-zero size.
-//
-// For every member with non-zero size, we need to set a value for
-// "start:" such that their raw contents don't overlap (or of course
-// overlap with a header) while minimizing wasted space.
-//
-// We don't really know where the first file should start without
-// computing the size of all of the headers and that presents a
-// problem since the start offset itself is technically a variable
-// width quantity. To work around this, we first compute the size of
-// all of the headers using a fixed width size string (00000000) and
-// then as long as the actual headers when written also left pads the
-// hexidecimal size to the same number of digits then we know how big
-// each header really is. We also need to add one since we always add
-// a blank "header" (a zero byte) according to the specification (this
-// makes is much easier to determine where the last header is).
-//
-// TODO(jawilson): handle alignment.
-//
-func layout_archive(headers []map[string]string) {
-	header_size := 0
-	for _, member := range headers {
-		if as_int64(member[SIZE_KEY]) > 0 {
-			member[START_KEY] = "00000000"
-			header_size += len(header_to_bytes(member))
+	if algorithm, ok := flags["compress"]; ok {
+		if err := writer.SetCompression(algorithm); err != nil {
+			return usage_error(err.Error())
 		}
 	}
-	// We always write an extra 0 byte after the headers (which
-	// reads as an empty header) and this tells a reader where the
-	// end of the headers is.
-	header_size += 1
-	start := int64(header_size)
-	for _, member := range headers {
-		if start > (1 << 31) {
-			panic("archive is currently to too large")
+	if value, ok := flags["align"]; ok {
+		alignment, err := strconv.ParseInt(value, 0, 64)
+		if err == nil {
+			err = writer.SetAlignment(alignment)
 		}
-		if as_int64(member[SIZE_KEY]) > 0 {
-			member[START_KEY] = fmt.Sprintf("%08x", start)
-			start += as_int64(member[SIZE_KEY])
+		if err != nil {
+			return usage_error("bad --align " + value)
 		}
 	}
+	return nil
 }
 
-// Convert a possibly zero prefixed hexidecimal number to and int64 or
-// panic.
-func as_int64(value string) int64 {
-	num, err := strconv.ParseInt(value, 16, 64)
-	if err != nil {
-		panic(err)
-	}
-	return num
+// Remove all of the leading "/"s from absolute paths (which turns "/"
+// itself into "").
+func make_path_relative_if_absolute(path string) string {
+	return strings.TrimLeft(path, "/")
 }
 
-//
-// Given an output archive filename and a set of headers (which must
-// include the sizes of all written elements), writes an archive file
-// by first laying out the archive, then writing all of the headers,
-// and then finally writing all of the files contents (currently all
-// read from disk which wont' work nicely when trying to append
-// archives).
-//
-func write_archive(archive_name string, headers []map[string]string, inputs []IOInfo) {
-	/* First we need to figure out where everything goes */
-	layout_archive(headers)
-
-	/* Open the output file */
-	output, err := os.Create(archive_name)
-	if err != nil {
-		panic(err)
+// This command copies an archive without the members matching any of
+// the patterns.
+func remove_command(flags map[string]string, patterns []string) error {
+	if _, ok := flags["where"]; !ok && len(patterns) < 1 {
+		return usage_error("remove needs the patterns (or --where) of the members to remove")
 	}
-
-	/* First write all of the headers */
-	for _, member := range headers {
-		if _, err := output.Write(header_to_bytes(member)); err != nil {
-			panic(err)
-		}
+	selector, err := new_member_selector(flags, patterns)
+	if err != nil {
+		return err
 	}
+	return copy_members(flags, selector, false)
+}
 
-	/* Write and empty header / zero byte to signal the end of headers. */
-	if _, err := output.Write([]byte{0}); err != nil {
-		panic(err)
+// This command copies the matching members (which are usually
+// selected by --where) of an archive to a new archive.
+func export_command(flags map[string]string, patterns []string) error {
+	selector, err := new_member_selector(flags, patterns)
+	if err != nil {
+		return err
 	}
+	return copy_members(flags, selector, true)
+}
 
-	/* Now write all of the raw data contents */
-	for j, member := range headers {
-		if as_int64(member[SIZE_KEY]) > 0 {
-			copy_bytes(
-				IOInfo{
-					file: output,
-				},
-				inputs[j])
-		}
+// This command allows the removal of some members from an archive
+func remove_by_file_name_command(flags map[string]string, names []string) error {
+	if len(names) < 1 {
+		return usage_error("remove-by-file-name needs the names of the members to remove")
 	}
-
-	/* Close the output file */
-	if err := output.Close(); err != nil {
-		panic(err)
+	selector, err := new_exact_member_selector(flags, names)
+	if err != nil {
+		return err
 	}
+	return copy_members(flags, selector, false)
 }
 
-//
-// This is a debugging routine that creates a textual version of a
-// header to show a user.
-//
-func header_to_string(header map[string]string) string {
-	result := ""
-	visit_by_sorted_key(header,
-		func(key string, value string) {
-			result += key
-			result += value
-			result += "\n"
-		})
-	return result
-}
-
-//
-// Convert the represetation of a header to the file-system disk byte
-// format.
-//
-// A header always ends with a byte of zero which is an empty string
-// and this routine always emits such an empty line.
-//
-func header_to_bytes(header map[string]string) []byte {
-	result := []byte{}
-	visit_by_sorted_key(header,
-		func(key string, value string) {
-			result = append(result, key_value_pair_to_bytes(key, value)...)
-		})
-	result = append(result, 0)
-	return result
-}
-
-func key_value_pair_to_bytes(key string, value string) []byte {
-	result := []byte{}
-	result = append(result, []byte(key)...)
-	result = append(result, []byte(value)...)
-	result = append(result, 0)
-	return result
-}
-
-// Read sequences of ULEB128 prefixed strings into a sequence of
-// "header" objects (i.e. map[string]string). Each header stops when
-// we encounter a single terminating zero byte (aka, empty "line")
-// that isn't itself the terminator for a header. While all header
-// sequences end in 0x0, 0x0, this may not be the first such
-// appearance of two zeros in a row (for example, a degenerate
-// filename with two U+0000 characters in a row).
-func read_headers(archive *os.File) []map[string]string {
-	result := []map[string]string{}
-	// end := int64(^uint64(0) >> 1)
-	for {
-		header := read_header(archive)
-		if len(header) == 0 {
-			break
+// Copy either the members the selector selects or the other members
+// (which always include the members without a file-name:) to the
+// output archive.
+func copy_members(flags map[string]string, selector *member_selector, selected bool) error {
+	return with_input_archive(flags, func(archive *corearchive.Reader) error {
+		// Check the patterns before writing anything.
+		if err := selector.check_patterns(archive); err != nil {
+			return err
 		}
-		if verbosity >= VERBOSITY_INFO {
-			fmt.Println(header_to_string(header))
+		copied := func(header corearchive.Header) bool {
+			if selected {
+				return selector.matches(header)
+			}
+			return !(header.Has(corearchive.FILE_NAME_KEY) && selector.matches(header))
 		}
-		result = append(result, header)
-	}
-	return result
+		archive.PlanReads(copied, false)
+		return write_archive(output_archive_name(flags), func(writer *corearchive.Writer) error {
+			for header, err := range archive.All() {
+				if err != nil {
+					return err
+				}
+				if !copied(header) {
+					continue
+				}
+				data, err := archive.Data(header)
+				if err != nil {
+					return err
+				}
+				if err := writer.AddSection(header, data); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
 }
 
-// Read a sequence of ULEB128 prefixed strings until we encounter an
-// empty string. Convert all non-empty strings into a
-// map[string]string where keys are all unicode characters preceding
-// and including the first ":" and values are the rest of the string.
-// This requires that the contents of a string be legal UTF-8, that
-// there exists at least one ":" in each non empty line.
-func read_header(archive *os.File) map[string]string {
-	result := make(map[string]string)
-	for {
-		str := read_string(archive)
-		if len(str) == 0 {
-			break
-		}
-		key_end := strings.Index(str, ":") + 1
-		result[str[0:key_end]] = str[key_end:]
+// The name of the archive given by --input-file ("-" for stdin when
+// there isn't one).
+func input_archive_name(flags map[string]string) string {
+	if name, ok := flags["input-file"]; ok {
+		return name
 	}
-	return result
+	return "-"
 }
 
-// Read a UTF-8 string until a null byte is encountered.
-func read_string(archive *os.File) string {
-	bytes := make([]byte, 0)
-	for {
-		b := read_byte(archive)
-		if b == 0 {
-			return string(bytes)
-		}
-		bytes = append(bytes, b)
+// The name of the archive given by --output-file ("-" for stdout when
+// there isn't one).
+func output_archive_name(flags map[string]string) string {
+	if name, ok := flags["output-file"]; ok {
+		return name
 	}
+	return "-"
 }
 
-// Reads a single byte that must be present and panic if any errors
-// occur
-func read_byte(archive *os.File) byte {
-	barray := make([]byte, 1)
-	n, err := archive.Read(barray)
-	if n != 1 {
-		panic("Expected to read one byte")
+// Open the named archive ("-" means stdin). Archives in files are
+// opened lazily so that only one header at a time is held in memory
+// (which is how every command goes through them). When stdin is a
+// pipe, all of the headers have to be read before any data and
+// members have to be read in order (which every command does).
+func open_archive(archive_name string) (*corearchive.Reader, error) {
+	if archive_name != "-" {
+		return corearchive.OpenLazyReader(archive_name)
 	}
+	info, err := os.Stdin.Stat()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return corearchive.NewStreamReader("stdin", os.Stdin)
 	}
-	return barray[0]
+	return corearchive.NewLazyReader("stdin", os.Stdin, info.Size())
 }
 
-// Reads a single byte and panics if any errors occur
-func write_byte(archive *os.File, b byte) {
-	barray := []byte{b}
-	n, err := archive.Write(barray)
-	if n != 1 {
-		panic("Expected to read one byte")
-	}
+// Call a handler function with a reader for the named archive. The
+// archive is automatically closed when the handler returns
+func with_archive(archive_name string, handler func(*corearchive.Reader) error) error {
+	archive, err := open_archive(archive_name)
 	if err != nil {
-		panic("Expected to write one byte")
+		return err
 	}
-}
-
-// Attempts to materialize in the filesystem as "filename" the bytes
-// from "start" to "start+size" from an archive.
-//
-// TODO(jawilson): various posix information that should be preserved
-// as well.
-//
-// TODO(jawilson): read and write in larger chunks than one byte!
-func copy_bytes(out_info IOInfo, in_info IOInfo) {
-
+	defer archive.Close()
 	if verbosity >= VERBOSITY_INFO {
-		fmt.Sprintf("Copy from %s to %s\n", in_info, out_info)
-	}
-
-	var input *os.File
-	var output *os.File
-
-	if in_info.file != nil {
-		input = in_info.file
-	} else {
-		in, err := os.Open(in_info.filename)
-		if err != nil {
-			panic(err)
-		}
-		input = in
-	}
-
-	if in_info.seek_offset > 0 {
-		offset, err := input.Seek(in_info.seek_offset, 0)
-		if err != nil {
-			panic(err)
-		}
-		if offset != in_info.seek_offset {
-			panic("failed to seek to correct position")
-		}
-	}
-
-	if out_info.file != nil {
-		output = out_info.file
-	} else {
-		// open output file
-		create_parent_directories(out_info.filename)
-		output_foo, err := os.Create(out_info.filename)
-		if err != nil {
-			panic(err)
-		}
-		output = output_foo
-	}
-
-	copy_bytes_to_output(output, input, in_info.size)
-
-	if in_info.file == nil {
-		if err := input.Close(); err != nil {
-			panic(err)
-		}
-	}
-
-	if out_info.file == nil {
-		if err := output.Close(); err != nil {
-			panic(err)
+		for header, err := range archive.All() {
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(os.Stderr, header.String())
 		}
 	}
+	return handler(archive)
 }
 
-//
-// Copy num_bytes from an input file to an output file as efficiently
-// as possbile.
-//
-func copy_bytes_to_output(output *os.File, input *os.File, num_bytes int64) {
-	buffer := make([]byte, BUFFER_SIZE)
-	for num_bytes > 0 {
-		if num_bytes < int64(BUFFER_SIZE) {
-			buffer = buffer[:num_bytes]
-		}
-		n, err := input.Read(buffer)
-		if err != nil && err != io.EOF {
-			panic(err)
-		}
-		if n == 0 {
-			panic("should always read at least one byte")
-		}
-		if _, err := output.Write(buffer); err != nil {
-			panic(err)
-		}
-		num_bytes -= int64(n)
-	}
+// Like with_archive for the archive given by --input-file.
+func with_input_archive(flags map[string]string, handler func(*corearchive.Reader) error) error {
+	return with_archive(input_archive_name(flags), handler)
 }
 
-// In order to write this file-name, ensure that all of its parent
-// directories exist.
+// Create the named archive ("-" means stdout) and call a handler
+// function to add all of the members to it. The archive is written
+// when the handler returns.
 //
-// TODO(jawilson): do we need to get posix info from the archive itself?
-//
-// TODO(jawilson): cache directories we know exist to avoid repeated
-// calls to os.Stat which could be slow
-func create_parent_directories(filename string) {
-	dir_path := filepath.Dir(filename)
-	if _, err := os.Stat(dir_path); os.IsNotExist(err) {
-		// TODO(jawilson): what should be mode really be?
-		err := os.MkdirAll(dir_path, 0750)
-		if err != nil {
-			panic(err)
-		}
+// A named archive is first written to "archive_name.<pid>.partial"
+// which only replaces archive_name once it is complete. So a failure
+// never leaves a partial archive behind and the output may be one of
+// the inputs (which are still being read while the archive is
+// written).
+func write_archive(archive_name string, handler func(*corearchive.Writer) error) error {
+	if archive_name == "-" {
+		return write_archive_to(os.Stdout, "stdout", handler)
 	}
-}
-
-//
-// Examine a single header and return non-localized errors and
-// warnings.
-//
-func validate_header(header map[string]string) []string {
-	result := []string{}
-
-	if !is_present(header, SIZE_KEY) {
-		result = append(result, "ERROR: A header does not have the required key -- size:")
+	partial_name := fmt.Sprintf("%s.%d.partial", archive_name, os.Getpid())
+	output, err := os.OpenFile(partial_name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
 	}
-
-	if is_present(header, ALIGN_KEY) {
-		result = append(result, "WARNING: This tool can doesn't respect alignment")
+	err = write_archive_to(output, archive_name, handler)
+	if close_err := output.Close(); err == nil {
+		err = close_err
 	}
-
-	if is_present(header, FILE_VERSION_KEY) {
-		result = append(result, "WARNING: This tool can doesn't handle multiple versions")
+	if err == nil {
+		err = os.Rename(partial_name, archive_name)
 	}
-
-	if is_present(header, DATA_COMPRESSION_ALGORITHM_KEY) !=
-		// bug, should be DATA_SIZE_KEY
-		is_present(header, DATA_COMPRESSION_ALGORITHM_KEY) {
-		result = append(result, "ERROR: FOO and BAR must match")
+	if err != nil {
+		os.Remove(partial_name)
 	}
-
-	// TODO:(jawilson): validate the layout which obviously can't be done here.
-
-	return result
+	return err
 }
 
-func is_present(m map[string]string, key string) bool {
-	if _, ok := m[key]; ok {
-		return true
-	} else {
-		return false
+func write_archive_to(output *os.File, archive_name string, handler func(*corearchive.Writer) error) error {
+	writer := corearchive.NewWriter(output)
+	if err := handler(writer); err != nil {
+		return err
 	}
-}
-
-//
-// Visit the keys value pairs of this map according to the the
-// "natural" sort order of the keys.
-//
-func visit_by_sorted_key(m map[string]string, visitor func(key string, value string)) {
-	keys := sorted_keys(m)
-	for _, key := range keys {
-		visitor(key, m[key])
+	if err := writer.Close(); err != nil {
+		return with_archive_name(archive_name, err)
 	}
+	return nil
 }
 
-//
-// Returns the keys of a map according to a sort function.
-//
-func sorted_keys(m map[string]string) []string {
-	result := []string{}
-	for key, _ := range m {
-		result = append(result, key)
+// Re-hash the data of every member that has a data-hash: and report
+// the ones that don't match.
+func verify_command(flags map[string]string, args []string) error {
+	selector, err := new_member_selector(flags, args)
+	if err != nil {
+		return err
+	}
+	failures := 0
+	err = with_input_archive(flags,
+		func(archive *corearchive.Reader) error {
+			archive_name := archive.Name()
+			return each_member(selector.members(archive), func(header corearchive.Header) error {
+				name := header[corearchive.FILE_NAME_KEY]
+				if !header.Has(corearchive.DATA_HASH_KEY) {
+					log_line(VERBOSITY_WARNING, "%s: %s: no data-hash", archive_name, name)
+					return nil
+				}
+				if err := archive.Verify(header); err != nil {
+					if !errors.Is(err, corearchive.ErrHashMismatch) {
+						return err
+					}
+					fmt.Printf("%s: %s: FAILED\n", archive_name, name)
+					failures++
+				} else if verbosity >= VERBOSITY_INFO {
+					fmt.Printf("%s: %s: OK\n", archive_name, name)
+				}
+				return nil
+			})
+		})
+	if err != nil {
+		return err
 	}
-
-	sort.Strings(result)
-
-	return result
-}
-
-// Return true if the given key is present in a header (even if it's
-// value is the empty string)
-func has_key(ht map[string]string, key string) bool {
-	_, is_present := ht[key]
-	return is_present
+	if failures > 0 {
+		return fmt.Errorf("%w: %d member(s) failed verification", corearchive.ErrHashMismatch, failures)
+	}
+	return nil
 }
 
-// Output the usage for this tool.
-func usage() {
-	fmt.Println(`Usage:    
-core-archive create {core-archive-filename} [filenames...]
-core-archive extract {core-archive-filename}
-core-archive extract-by-file-name {core-archive-filename} [filenames...]
-core-archive append [output archive] [archive 0] ...
-core-archive list [archive 0] [archive 1] ...
-core-archive headers [archive 0] [archive 1] ...
-core-archive remove-by-file-name [archive 0] [filenames...]
-core-archive --usage
-core-archive --version`)
+// Handle --verbose and --verbosity (which wins when both are given).
+func set_verbosity(flags map[string]string) error {
+	if flags["verbose"] == "true" {
+		verbosity = VERBOSITY_INFO
+	}
+	if level, ok := flags["verbosity"]; ok {
+		index := slices.Index(verbosity_levels, level)
+		if index < 0 {
+			return usage_error("--verbosity must be one of " + strings.Join(verbosity_levels, ", "))
+		}
+		verbosity = uint(index)
+	}
+	return nil
 }
 
 // Obviously the entry point to this tool.
 func main() {
 	if len(os.Args) <= 1 {
-		usage()
+		usage(os.Stdout)
 		return
 	}
-	command := os.Args[1]
-	command_args := os.Args[2:]
-	switch command {
-	case "append":
-		append_command(command_args)
-	case "create":
-		create_command(command_args)
-	case "extract":
-		extract_command(command_args)
-	case "extract-by-file-name":
-		extract_by_file_name_command(command_args)
-	case "list":
-		list_command(command_args)
-	case "headers":
-		headers_command(command_args)
-	case "remove-by-file-name":
-		remove_by_filename_command(command_args)
-	default:
-		usage()
+	name := os.Args[1]
+	switch name {
+	case "--usage", "--help", "-h", "help":
+		if command := find_command(strings.Join(os.Args[2:], " ")); name == "help" && command != nil {
+			command_usage(os.Stdout, command)
+		} else {
+			usage(os.Stdout)
+		}
+		return
+	}
+	command := find_command(name)
+	if command == nil {
+		fail(usage_error("unknown command " + name))
+	}
+	flags, args, err := parse_flags(command, os.Args[2:])
+	if err == nil {
+		err = set_verbosity(flags)
+	}
+	if err == nil && flags["help"] == "true" {
+		command_usage(os.Stdout, command)
+		return
+	}
+	if err == nil {
+		err = command.run(flags, args)
+	}
+	if err != nil {
+		fail(err)
 	}
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/jasonaaronwilson/omni-archive/src/go/corearchive"
+)
+
+// A file found by create. Its lstat() (and readlink() for a symbolic
+// link) is done by one of the workers.
+type create_job struct {
+	path  string
+	name  string
+	entry fs.DirEntry
+	info  fs.FileInfo
+	link  string
+	err   error
+	done  chan struct{}
+}
+
+func (job *create_job) stat() {
+	defer close(job.done)
+	job.info, job.err = job.entry.Info()
+	if job.err == nil && job.info.Mode()&fs.ModeSymlink != 0 {
+		job.link, job.err = os.Readlink(job.path)
+	}
+}
+
+// How many files past the oldest one that hasn't been added yet may
+// be looked at.
+const CREATE_JOBS_AHEAD = 64
+
+// Adds the files create finds to an archive in the order they are
+// found while (with --jobs) looking at several of them at once. The
+// data of the files is only read (and hashed or compressed) when the
+// Writer is closed.
+type file_adder struct {
+	writer  *corearchive.Writer
+	jobs    int
+	queue   chan *create_job
+	workers sync.WaitGroup
+	// The files that haven't been added yet (in order).
+	pending []*create_job
+	// The first member for each file with several hard links
+	// (which is the one with the data).
+	hard_links map[file_identity]string
+}
+
+func new_file_adder(writer *corearchive.Writer, jobs int) *file_adder {
+	adder := &file_adder{
+		writer:     writer,
+		jobs:       jobs,
+		hard_links: make(map[file_identity]string),
+	}
+	if jobs > 1 {
+		adder.queue = make(chan *create_job)
+		for range jobs {
+			adder.workers.Go(func() {
+				for job := range adder.queue {
+					job.stat()
+				}
+			})
+		}
+	}
+	return adder
+}
+
+// Add the file at path as the member name (though maybe not until
+// some later call).
+func (adder *file_adder) add(path string, name string, entry fs.DirEntry) error {
+	job := &create_job{
+		path:  path,
+		name:  name,
+		entry: entry,
+		done:  make(chan struct{}),
+	}
+	if adder.jobs == 1 {
+		job.stat()
+		return adder.add_job(job)
+	}
+	adder.queue <- job
+	adder.pending = append(adder.pending, job)
+	if err := adder.add_jobs(false); err != nil {
+		return err
+	}
+	if len(adder.pending) > adder.jobs*CREATE_JOBS_AHEAD {
+		return adder.add_jobs(true)
+	}
+	return nil
+}
+
+// Add every file that is still pending.
+func (adder *file_adder) finish() error {
+	for len(adder.pending) > 0 {
+		if err := adder.add_jobs(true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop the workers (which finish() doesn't do so that it can be
+// called before adding more files).
+func (adder *file_adder) stop() {
+	if adder.queue != nil {
+		close(adder.queue)
+		adder.workers.Wait()
+	}
+}
+
+// Add the files that have been looked at (waiting for the oldest one
+// when wait is true) and stop at the first error.
+func (adder *file_adder) add_jobs(wait bool) error {
+	for len(adder.pending) > 0 {
+		job := adder.pending[0]
+		if !wait {
+			select {
+			case <-job.done:
+			default:
+				return nil
+			}
+		}
+		<-job.done
+		adder.pending = adder.pending[1:]
+		wait = false
+		if err := adder.add_job(job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (adder *file_adder) add_job(job *create_job) error {
+	if job.err != nil {
+		return job.err
+	}
+	if job.info.Mode()&fs.ModeSocket != 0 {
+		log_line(VERBOSITY_WARNING, "Skipping socket %s", job.path)
+		return nil
+	}
+	log_line(VERBOSITY_INFO, "Adding %s", job.path)
+	return add_file(adder.writer, job.path, job.name, job.info, job.link, adder.hard_links)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jasonaaronwilson/omni-archive/src/go/corearchive"
+)
+
+// The exit status of core-archive-command tells scripts what kind of
+// failure happened. These values are part of the interface of the
+// tool (and are shown by usage()) so never renumber them, only add
+// new ones.
+const (
+	EXIT_SUCCESS          = 0
+	EXIT_USAGE            = 1
+	EXIT_IO_ERROR         = 2
+	EXIT_TRUNCATED_HEADER = 3
+	EXIT_TRUNCATED_DATA   = 4
+	EXIT_BAD_SIZE         = 5
+	EXIT_LAYOUT_OVERLAP   = 6
+	EXIT_MEMBER_NOT_FOUND = 7
+	EXIT_MALFORMED_HEADER = 8
+	EXIT_HASH_MISMATCH    = 9
+	EXIT_UNSUPPORTED      = 10
+	EXIT_CORRUPT_DATA     = 11
+	EXIT_UNSAFE_PATH      = 12
+	EXIT_NOT_STREAMABLE   = 13
+)
+
+// A bad command line.
+var ErrUsage = errors.New("usage")
+
+// The first entry whose error matches (according to errors.Is)
+// determines the exit status. Anything else is treated as an I/O
+// error.
+var exit_statuses = []struct {
+	err         error
+	status      int
+	description string
+}{
+	{ErrUsage, EXIT_USAGE, "bad command line"},
+	{nil, EXIT_IO_ERROR, "any other error (missing files, permissions, etc.)"},
+	{corearchive.ErrTruncatedHeader, EXIT_TRUNCATED_HEADER, "an archive ends in the middle of its headers"},
+	{corearchive.ErrTruncatedData, EXIT_TRUNCATED_DATA, "an archive ends in the middle of a member's data"},
+	{corearchive.ErrBadSize, EXIT_BAD_SIZE, "a size: or start: value is malformed or wrong"},
+	{corearchive.ErrLayoutOverlap, EXIT_LAYOUT_OVERLAP, "member data overlaps headers or other members"},
+	{corearchive.ErrMemberNotFound, EXIT_MEMBER_NOT_FOUND, "a requested member is not in the archive"},
+	{corearchive.ErrMalformedHeader, EXIT_MALFORMED_HEADER, "a header breaks the format's rules or our limits"},
+	{corearchive.ErrHashMismatch, EXIT_HASH_MISMATCH, "member data doesn't match its data-hash:"},
+	{corearchive.ErrUnknownHashAlgorithm, EXIT_UNSUPPORTED, "an archive needs an algorithm or file type we don't support"},
+	{corearchive.ErrUnknownCompressionAlgorithm, EXIT_UNSUPPORTED, ""},
+	{corearchive.ErrUnknownFileType, EXIT_UNSUPPORTED, ""},
+	{corearchive.ErrCorruptData, EXIT_CORRUPT_DATA, "compressed member data is corrupt"},
+	{ErrUnsafePath, EXIT_UNSAFE_PATH, "a member would be extracted outside of the output directory"},
+	{corearchive.ErrNotStreamable, EXIT_NOT_STREAMABLE, "an archive read from a pipe needs too much of its data out of order"},
+}
+
+func usage_error(message string) error {
+	return fmt.Errorf("%w: %s", ErrUsage, message)
+}
+
+// Returns the exit status for an error.
+func exit_status(err error) int {
+	for _, entry := range exit_statuses {
+		if errors.Is(err, entry.err) {
+			return entry.status
+		}
+	}
+	return EXIT_IO_ERROR
+}
+
+// Print a single line describing an error to stderr and exit with
+// the matching exit status.
+func fail(err error) {
+	if errors.Is(err, ErrUsage) {
+		fmt.Fprintf(os.Stderr, "core-archive-command: %v (try --usage)\n", err)
+	} else {
+		fmt.Fprintf(os.Stderr, "core-archive-command: %v\n", err)
+	}
+	os.Exit(exit_status(err))
+}
+
+// Describe the exit statuses as part of the usage.
+func exit_status_usage(output io.Writer) {
+	fmt.Fprintln(output, "Exit status:")
+	fmt.Fprintf(output, "%3d  success\n", EXIT_SUCCESS)
+	for _, entry := range exit_statuses {
+		// Entries without a description share a status with an
+		// earlier entry.
+		if entry.description != "" {
+			fmt.Fprintf(output, "%3d  %s\n", entry.status, entry.description)
+		}
+	}
+}
+
+// Errors from a Writer don't know the name of the archive being
+// written so fill it in.
+func with_archive_name(archive_name string, err error) error {
+	var archive_error *corearchive.ArchiveError
+	if errors.As(err, &archive_error) && archive_error.Archive == "" {
+		archive_error.Archive = archive_name
+	}
+	return err
+}
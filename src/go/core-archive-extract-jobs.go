@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/jasonaaronwilson/omni-archive/src/go/corearchive"
+)
+
+// The data of a regular file decompressed (and checked) ahead of time
+// into a temporary file in the output directory by one of the
+// workers.
+type staged_data struct {
+	// The temporary file (empty if it couldn't even be created).
+	name string
+	// Why the data couldn't be written or checked (in which case
+	// name has whatever was written before that happened).
+	err error
+}
+
+// A member waiting to be extracted (once its data is staged).
+type extract_job struct {
+	header corearchive.Header
+	// Only set for the regular files the workers stage.
+	staged_name string
+	staged      *staged_data
+	done        chan struct{}
+}
+
+// How many members past the oldest one that hasn't been extracted
+// yet may be staged.
+const EXTRACT_JOBS_AHEAD = 16
+
+// Handle --jobs for the commands that have it.
+func parse_jobs(flags map[string]string) (int, error) {
+	text, ok := flags["jobs"]
+	if !ok {
+		return 1, nil
+	}
+	jobs, err := strconv.Atoi(text)
+	if err != nil || jobs < 1 {
+		return 0, usage_error("bad --jobs " + text)
+	}
+	return jobs, nil
+}
+
+// Extract the members in archive order. With --jobs, the data of the
+// regular files is decompressed (and checked) on a pool of workers
+// first but everything that changes the output directory (including
+// moving the staged data into place) still happens one member at a
+// time in archive order. The results are therefore the same as
+// without --jobs even when extracting a member fails (which stops
+// the extraction before any later member is touched).
+//
+// Members are extracted one at a time when the archive is read from
+// a pipe (since its data can only be read in order).
+func (extractor *extractor) extract_members(archive *corearchive.Reader, members iter.Seq2[corearchive.Header, error]) error {
+	jobs := extractor.options.jobs
+	if jobs == 1 || archive.IsStream() {
+		return each_member(members, func(header corearchive.Header) error {
+			if !header.Has(corearchive.FILE_NAME_KEY) {
+				return nil
+			}
+			return extractor.extract(archive, header, header[corearchive.FILE_NAME_KEY], nil)
+		})
+	}
+
+	queue := make(chan *extract_job)
+	workers := sync.WaitGroup{}
+	for range jobs {
+		workers.Go(func() {
+			for job := range queue {
+				job.staged = extractor.stage_data(archive, job.header, job.staged_name)
+				close(job.done)
+			}
+		})
+	}
+	// The members that haven't been extracted yet (in archive
+	// order).
+	pending := []*extract_job{}
+	staged := 0
+	defer func() {
+		close(queue)
+		workers.Wait()
+		for _, job := range pending {
+			remove_staged(extractor.output, job.staged)
+		}
+	}()
+	// Extract the members that are ready (waiting for the oldest
+	// one when wait is true) and stop at the first error.
+	extract_jobs := func(wait bool) error {
+		for len(pending) > 0 {
+			job := pending[0]
+			if !wait {
+				select {
+				case <-job.done:
+				default:
+					return nil
+				}
+			}
+			<-job.done
+			pending = pending[1:]
+			wait = false
+			err := extractor.extract(archive, job.header, job.header[corearchive.FILE_NAME_KEY], job.staged)
+			remove_staged(extractor.output, job.staged)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := each_member(members, func(header corearchive.Header) error {
+		if !header.Has(corearchive.FILE_NAME_KEY) {
+			return nil
+		}
+		job := &extract_job{header: header, done: make(chan struct{})}
+		_, ok := extractor.options.transformer.transform(header[corearchive.FILE_NAME_KEY])
+		if ok && header.FileType() == corearchive.FILE_TYPE_REGULAR {
+			staged++
+			job.staged_name = fmt.Sprintf(".core-archive-command.%d.%d.partial", os.Getpid(), staged)
+			queue <- job
+		} else {
+			close(job.done)
+		}
+		pending = append(pending, job)
+		if err := extract_jobs(false); err != nil {
+			return err
+		}
+		if len(pending) > jobs*EXTRACT_JOBS_AHEAD {
+			return extract_jobs(true)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for len(pending) > 0 {
+		if err := extract_jobs(true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the (decompressed) data of a member to a temporary file named
+// name in the output directory and check it (with --verify).
+func (extractor *extractor) stage_data(archive *corearchive.Reader, header corearchive.Header, name string) *staged_data {
+	contents, verifier, err := extractor.open_data(archive, header)
+	if err != nil {
+		return &staged_data{err: err}
+	}
+	defer contents.Close()
+	output, err := extractor.output.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return &staged_data{err: err}
+	}
+	return &staged_data{name: name, err: write_data(archive, header, contents, verifier, output)}
+}
+
+// Move staged data to filename (leaving the same file behind as
+// extract_data does when the data couldn't be written or checked).
+// Like extract_data, a file that already exists is written to
+// (rather than replaced) unless verifying.
+func (extractor *extractor) commit_staged(staged *staged_data, filename string) error {
+	if staged.err != nil && extractor.options.verify {
+		return staged.err
+	}
+	if info, err := extractor.output.Lstat(filename); err == nil && !extractor.options.verify && info.Mode().IsRegular() {
+		if err := extractor.copy_staged(staged.name, filename); err != nil {
+			return err
+		}
+		return staged.err
+	}
+	if err := extractor.output.Rename(staged.name, filename); err != nil {
+		return err
+	}
+	return staged.err
+}
+
+func (extractor *extractor) copy_staged(name string, filename string) error {
+	input, err := extractor.output.Open(name)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := extractor.output.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, input); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+// Remove any staged data that wasn't moved into place.
+func remove_staged(output output_directory, staged *staged_data) {
+	if staged != nil && staged.name != "" {
+		output.Remove(staged.name)
+	}
+}
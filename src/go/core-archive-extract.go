@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jasonaaronwilson/omni-archive/src/go/corearchive"
+)
+
+// The options shared by all of the commands that extract members.
+type extract_options struct {
+	// Check each member against its data-hash: before it is put
+	// in place.
+	verify bool
+	// Restore the owner and group of each member (which normally
+	// only root can do).
+	preserve_owner bool
+	// Use the posix-owner-number: and posix-group-number: even
+	// when there is a user or group with the same name as the
+	// member's posix-owner-name: or posix-group-name:.
+	numeric_owner bool
+	// Restore the permissions of each member instead of leaving
+	// them to the umask.
+	same_permissions bool
+	// Extract members with absolute names, ".." in their names,
+	// or inside of symbolic links (instead of rejecting them).
+	allow_unsafe_paths bool
+	// What to do about files that already exist (one of the
+	// OVERWRITE_* values).
+	overwrite string
+	// Where to extract members to (instead of the current
+	// directory).
+	output_directory string
+	// How member names are turned into file names.
+	transformer *name_transformer
+	// How many members to decompress (and check) at once.
+	jobs int
+}
+
+// Handle the flags shared by all of the commands that extract
+// members.
+func parse_extract_options(flags map[string]string) (extract_options, error) {
+	transformer, err := parse_name_transformer(flags)
+	if err != nil {
+		return extract_options{}, err
+	}
+	output_directory, ok := flags["output-directory"]
+	if !ok {
+		output_directory = "."
+	}
+	overwrite, ok := flags["overwrite"]
+	if !ok {
+		overwrite = OVERWRITE_NO
+	}
+	if !slices.Contains(overwrite_values, overwrite) {
+		return extract_options{}, usage_error("--overwrite must be one of " + strings.Join(overwrite_values, ", "))
+	}
+	jobs, err := parse_jobs(flags)
+	if err != nil {
+		return extract_options{}, err
+	}
+	return extract_options{
+		verify:             flags["verify"] == "true",
+		preserve_owner:     flags["preserve-owner"] == "true",
+		numeric_owner:      flags["numeric-owner"] == "true",
+		same_permissions:   flags["no-same-permissions"] != "true",
+		allow_unsafe_paths: flags["allow-unsafe-paths"] == "true",
+		overwrite:          overwrite,
+		output_directory:   output_directory,
+		transformer:        transformer,
+		jobs:               jobs,
+	}, nil
+}
+
+// An extractor materializes members in the file system. The posix
+// information of directories is only restored by finish() since
+// writing their children would otherwise change their modification
+// times (and their permissions might not even allow that).
+//
+// Members that would end up outside of the output directory (or that
+// would overwrite a file with --overwrite=no) are reported (and
+// counted) as they are skipped instead of stopping the
+// extraction. finish() then fails if there were any.
+type extractor struct {
+	options     extract_options
+	output      output_directory
+	directories []extracted_directory
+	// Where each member was extracted to (so hard links can find
+	// their targets).
+	extracted       map[string]string
+	rejected        int
+	not_overwritten int
+	// Where answers for --overwrite=ask come from.
+	answers *bufio.Reader
+}
+
+// Create an extractor that extracts members into the output directory
+// (creating it if needed). It must be closed.
+func new_extractor(options extract_options) (*extractor, error) {
+	if err := os.MkdirAll(options.output_directory, 0777); err != nil {
+		return nil, err
+	}
+	output, err := open_output_directory(options.output_directory, options.allow_unsafe_paths)
+	if err != nil {
+		return nil, err
+	}
+	return &extractor{
+		options:   options,
+		output:    output,
+		extracted: make(map[string]string),
+	}, nil
+}
+
+type extracted_directory struct {
+	archive  *corearchive.Reader
+	header   corearchive.Header
+	filename string
+}
+
+// Only extract *files* explicitly requested on the command
+// line. (Since shells and POSIX style filenames (unless explicitly
+// ending in say "/") it's hard to tell directories from files to
+// infer intent).
+func extract_by_file_name_command(flags map[string]string, files []string) error {
+	if len(files) < 1 {
+		return usage_error("extract-by-file-name needs the names of the members to extract")
+	}
+	selector, err := new_exact_member_selector(flags, files)
+	if err != nil {
+		return err
+	}
+	return extract_selected_members(flags, selector)
+}
+
+// Extract the members matching the patterns on the command line (or
+// every member).
+func extract_command(flags map[string]string, patterns []string) error {
+	selector, err := new_member_selector(flags, patterns)
+	if err != nil {
+		return err
+	}
+	return extract_selected_members(flags, selector)
+}
+
+// Every pattern is checked before anything is extracted and then the
+// members are extracted in the order they are in the archive (so the
+// archive can be read from a pipe) even though their data may be
+// decompressed several at a time with --jobs.
+func extract_selected_members(flags map[string]string, selector *member_selector) error {
+	options, err := parse_extract_options(flags)
+	if err != nil {
+		return err
+	}
+	archive_name := input_archive_name(flags)
+	if err := check_answers_source(archive_name, options); err != nil {
+		return err
+	}
+	return with_archive(archive_name,
+		func(archive *corearchive.Reader) error {
+			// Check the patterns before creating the output
+			// directory.
+			if err := selector.check_patterns(archive); err != nil {
+				return err
+			}
+			extractor, err := new_extractor(options)
+			if err != nil {
+				return err
+			}
+			defer extractor.close()
+			if err := extractor.extract_members(archive, selector.members(archive)); err != nil {
+				return err
+			}
+			return extractor.finish()
+		})
+}
+
+// Attempts to materialize in the filesystem a member of an archive
+// named name (decompressing its data if needed) and then restore its
+// posix information. The file name comes from transforming the name
+// (with --strip-components and --transform). The data of a regular
+// file may already be staged (see stage_data).
+func (extractor *extractor) extract(archive *corearchive.Reader, header corearchive.Header, name string, staged *staged_data) error {
+	filename, ok := extractor.options.transformer.transform(name)
+	if !ok {
+		log_line(VERBOSITY_INFO, "%s: skipped (nothing is left of its name)", name)
+		return nil
+	}
+
+	if err := extractor.check_paths(header, filename); err != nil {
+		if !errors.Is(err, ErrUnsafePath) {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "core-archive-command: rejected %v\n", with_member(archive, header, err))
+		extractor.rejected++
+		return nil
+	}
+
+	mode, err := header.FileMode()
+	if err != nil {
+		return with_member(archive, header, err)
+	}
+	permissions := mode.Perm()
+	if !header.Has(corearchive.POSIX_FILE_MODE_KEY) {
+		permissions = 0666
+	}
+
+	file_type := header.FileType()
+	if file_type == corearchive.FILE_TYPE_DIRECTORY {
+		// Until finish() we need to be able to write into
+		// the directory no matter what its mode is.
+		permissions := fs.FileMode(0700)
+		if !extractor.options.same_permissions {
+			permissions = 0777
+		}
+		log_line(VERBOSITY_INFO, "%s: directory", filename)
+		if err := extractor.output.MkdirAll(filename, permissions); err != nil {
+			return err
+		}
+		extractor.directories = append(extractor.directories, extracted_directory{archive, header, filename})
+		extractor.extracted[header[corearchive.FILE_NAME_KEY]] = filename
+		return nil
+	}
+
+	output_name, action, err := extractor.choose_output_name(header, filename)
+	if err != nil {
+		return with_member(archive, header, err)
+	}
+	// Members that aren't extracted as themselves (because they
+	// are skipped or renamed) are always logged.
+	level := uint(VERBOSITY_INFO)
+	if output_name != filename {
+		level = VERBOSITY_ERROR
+	}
+	log_line(level, "%s: %s", filename, action)
+	if output_name == "" {
+		return nil
+	}
+	filename = output_name
+
+	if err := extractor.create_parent_directories(filename); err != nil {
+		return err
+	}
+	switch file_type {
+	case corearchive.FILE_TYPE_REGULAR:
+		if err := extractor.extract_data(archive, header, filename, staged); err != nil {
+			return err
+		}
+	case corearchive.FILE_TYPE_HARD_LINK:
+		// The target shares everything (including the posix
+		// information) with the link.
+		if err := extractor.remove_existing(filename); err != nil {
+			return err
+		}
+		if err := extractor.output.Link(extractor.link_target(header), filename); err != nil {
+			return err
+		}
+		extractor.extracted[header[corearchive.FILE_NAME_KEY]] = filename
+		return nil
+	case corearchive.FILE_TYPE_SYMBOLIC_LINK:
+		if err = extractor.remove_existing(filename); err == nil {
+			err = extractor.output.Symlink(header[corearchive.LINK_TARGET_KEY], filename)
+		}
+	case corearchive.FILE_TYPE_FIFO, corearchive.FILE_TYPE_CHARACTER_DEVICE, corearchive.FILE_TYPE_BLOCK_DEVICE:
+		if err = extractor.remove_existing(filename); err == nil {
+			err = make_special_file(extractor.output, filename, header, permissions)
+		}
+	default:
+		err = fmt.Errorf("%w: %s", corearchive.ErrUnknownFileType, file_type)
+	}
+	if err != nil {
+		return with_member(archive, header, err)
+	}
+	extractor.extracted[header[corearchive.FILE_NAME_KEY]] = filename
+	return extractor.restore_posix_information(archive, header, filename)
+}
+
+// Returns an error wrapping ErrUnsafePath when extracting a member
+// would touch something outside of the output directory.
+func (extractor *extractor) check_paths(header corearchive.Header, filename string) error {
+	if extractor.options.allow_unsafe_paths {
+		return nil
+	}
+	if err := check_member_path(filename); err != nil {
+		return err
+	}
+	if header.FileType() == corearchive.FILE_TYPE_HARD_LINK {
+		if err := check_member_path(extractor.link_target(header)); err != nil {
+			return fmt.Errorf("hard link to %w", err)
+		}
+	}
+	return check_parent_directories(extractor.output, filename)
+}
+
+// Where the target of a hard link was extracted to (or would have
+// been when it wasn't extracted this time).
+func (extractor *extractor) link_target(header corearchive.Header) string {
+	target := header[corearchive.LINK_TARGET_KEY]
+	if extracted, ok := extractor.extracted[target]; ok {
+		return extracted
+	}
+	if transformed, ok := extractor.options.transformer.transform(target); ok {
+		return transformed
+	}
+	return target
+}
+
+// Write the data of a regular file.
+//
+// When verifying, the data is first written to a temporary
+// "filename.<pid>.partial" file which is only renamed to filename
+// once we know the data matches the member's data-hash: (so a
+// corrupted member never replaces a good file). The data-hash: is of
+// the stored data so it is checked before decompression. Staged data
+// has already been written (and checked) and only has to be moved
+// into place.
+func (extractor *extractor) extract_data(archive *corearchive.Reader, header corearchive.Header, filename string, staged *staged_data) error {
+	var contents io.ReadCloser
+	var verifier *corearchive.Verifier
+	if staged == nil {
+		var err error
+		contents, verifier, err = extractor.open_data(archive, header)
+		if err != nil {
+			return err
+		}
+		defer contents.Close()
+	} else if staged.name == "" {
+		return staged.err
+	}
+
+	// Never write through a symbolic link (or into a FIFO) that is
+	// where the file should be.
+	if info, err := extractor.output.Lstat(filename); err == nil && !info.Mode().IsRegular() {
+		if err := extractor.remove_existing(filename); err != nil {
+			return err
+		}
+	}
+	if staged != nil {
+		return extractor.commit_staged(staged, filename)
+	}
+
+	output_name := filename
+	if extractor.options.verify {
+		output_name = fmt.Sprintf("%s.%d.partial", filename, os.Getpid())
+		defer extractor.output.Remove(output_name)
+	}
+	output, err := extractor.output.OpenFile(output_name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if err := write_data(archive, header, contents, verifier, output); err != nil {
+		return err
+	}
+	if extractor.options.verify {
+		return extractor.output.Rename(output_name, filename)
+	}
+	return nil
+}
+
+// Returns the (decompressed) data of a member and, with --verify, the
+// Verifier that checks it as it is read.
+func (extractor *extractor) open_data(archive *corearchive.Reader, header corearchive.Header) (io.ReadCloser, *corearchive.Verifier, error) {
+	data, err := archive.Data(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	var verifier *corearchive.Verifier
+	var raw io.Reader = data
+	if extractor.options.verify {
+		verifier, err = corearchive.NewVerifier(header)
+		if err != nil {
+			return nil, nil, with_member(archive, header, err)
+		}
+		raw = io.TeeReader(data, verifier)
+	}
+	contents, err := corearchive.Decompress(header, raw)
+	if err != nil {
+		return nil, nil, with_member(archive, header, err)
+	}
+	return contents, verifier, nil
+}
+
+// Copy the data of a member to output (which is closed) and then
+// check it matches its data-hash: (when verifier isn't nil).
+func write_data(archive *corearchive.Reader, header corearchive.Header, contents io.Reader, verifier *corearchive.Verifier, output *os.File) error {
+	if _, err := io.Copy(output, contents); err != nil {
+		output.Close()
+		return with_member(archive, header, err)
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+	if verifier != nil {
+		if err := verifier.Verify(); err != nil {
+			return with_member(archive, header, err)
+		}
+	}
+	return nil
+}
+
+// Links, FIFOs, and devices can't be created on top of an existing
+// file.
+func (extractor *extractor) remove_existing(filename string) error {
+	if err := extractor.output.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Restore the posix information of the directories we extracted. The
+// deepest directories are done first so that restoring a parent's
+// permissions can't stop us from restoring its children. Returns an
+// error wrapping ErrUnsafePath if any members were rejected.
+func (extractor *extractor) finish() error {
+	for i := len(extractor.directories) - 1; i >= 0; i-- {
+		directory := extractor.directories[i]
+		if err := extractor.restore_posix_information(directory.archive, directory.header, directory.filename); err != nil {
+			return err
+		}
+	}
+	extractor.directories = nil
+	if extractor.rejected > 0 {
+		return fmt.Errorf("%w: %d member(s) rejected (see --allow-unsafe-paths)", ErrUnsafePath, extractor.rejected)
+	}
+	if extractor.not_overwritten > 0 {
+		return fmt.Errorf("%w: %d member(s) not overwritten (see --overwrite)", fs.ErrExist, extractor.not_overwritten)
+	}
+	return nil
+}
+
+func (extractor *extractor) close() error {
+	return extractor.output.Close()
+}
+
+// Restore the owner (when asked), permissions (unless asked not to),
+// and modification time of an extracted member. The owner is done
+// first since changing it clears the setuid and setgid bits.
+func (extractor *extractor) restore_posix_information(archive *corearchive.Reader, header corearchive.Header, filename string) error {
+	if extractor.options.preserve_owner {
+		owner, group, err := header.Owner()
+		if err != nil {
+			return with_member(archive, header, err)
+		}
+		if !extractor.options.numeric_owner {
+			owner, group = lookup_owner(header, owner, group)
+		}
+		if owner != -1 || group != -1 {
+			if err := extractor.output.Lchown(filename, owner, group); err != nil {
+				return err
+			}
+		}
+	}
+	// There is no lchmod() and symbolic links ignore their
+	// permissions anyways.
+	symbolic_link := header.FileType() == corearchive.FILE_TYPE_SYMBOLIC_LINK
+	if extractor.options.same_permissions && header.Has(corearchive.POSIX_FILE_MODE_KEY) && !symbolic_link {
+		mode, err := header.FileMode()
+		if err != nil {
+			return with_member(archive, header, err)
+		}
+		if err := extractor.output.Chmod(filename, mode&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	modification_time, err := header.ModTime()
+	if err != nil {
+		return with_member(archive, header, err)
+	}
+	if modification_time.IsZero() {
+		return nil
+	}
+	if symbolic_link {
+		return set_symbolic_link_modification_time(extractor.output, filename, modification_time)
+	}
+	// The zero time leaves the access time alone.
+	return extractor.output.Chtimes(filename, time.Time{}, modification_time)
+}
+
+// Prefer the user and group on this machine with the member's
+// posix-owner-name: and posix-group-name: over the recorded numbers
+// (which may mean someone else entirely on this machine).
+func lookup_owner(header corearchive.Header, owner int, group int) (int, int) {
+	if name := header[corearchive.POSIX_OWNER_NAME_KEY]; name != "" {
+		if found, err := user.Lookup(name); err == nil {
+			if id, err := strconv.Atoi(found.Uid); err == nil {
+				owner = id
+			}
+		}
+	}
+	if name := header[corearchive.POSIX_GROUP_NAME_KEY]; name != "" {
+		if found, err := user.LookupGroup(name); err == nil {
+			if id, err := strconv.Atoi(found.Gid); err == nil {
+				group = id
+			}
+		}
+	}
+	return owner, group
+}
+
+// In order to write this file-name, ensure that all of its parent
+// directories exist. Directories that aren't members of the archive
+// get the default permissions (limited by the umask).
+//
+// TODO(jawilson): cache directories we know exist to avoid repeated
+// calls to Lstat which could be slow
+func (extractor *extractor) create_parent_directories(filename string) error {
+	dir_path := filepath.Dir(filename)
+	if _, err := extractor.output.Lstat(dir_path); errors.Is(err, fs.ErrNotExist) {
+		return extractor.output.MkdirAll(dir_path, 0777)
+	}
+	return nil
+}
+
+// Describe which member of which archive an error is about.
+func with_member(archive *corearchive.Reader, header corearchive.Header, err error) error {
+	return &corearchive.ArchiveError{
+		Archive: archive.Name(),
+		Member:  header[corearchive.FILE_NAME_KEY],
+		Offset:  -1,
+		Err:     err,
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A flag understood by one or more commands. Flags are written as
+// "--name=value" or "--name value" (or with one of the aliases
+// instead of "--name"). Boolean flags don't need a value and
+// "--name" alone means "--name=true".
+type flag_definition struct {
+	name    string
+	aliases []string
+	// How the value is shown in the help (empty for boolean
+	// flags).
+	value string
+	// Whether the flag may be given more than once (see
+	// flag_values).
+	repeatable  bool
+	description string
+}
+
+// A command (the first argument) along with the flags it understands
+// and what its other arguments are.
+type command_definition struct {
+	name        string
+	aliases     []string
+	arguments   string
+	description string
+	flags       []*flag_definition
+	run         func(flags map[string]string, args []string) error
+}
+
+// These flags have the same names, aliases, and meanings as they do
+// for the C oarchive.
+var (
+	input_file_flag = &flag_definition{
+		name:        "input-file",
+		aliases:     []string{"--input", "-i"},
+		value:       "FILE",
+		description: "The input archive (stdin is used if this is \"-\" or not given).",
+	}
+	output_file_flag = &flag_definition{
+		name:        "output-file",
+		aliases:     []string{"--output", "-o"},
+		value:       "FILE",
+		description: "The archive to write (stdout is used if this is \"-\" or not given).",
+	}
+	verbose_flag = &flag_definition{
+		name:        "verbose",
+		aliases:     []string{"-v"},
+		description: "Log what is being done to stderr (the same as --verbosity=info).",
+	}
+	overwrite_flag = &flag_definition{
+		name:        "overwrite",
+		value:       strings.Join(overwrite_values, "|"),
+		description: "What to do about files that already exist (the default is no).",
+	}
+)
+
+// The flags only this implementation has.
+var (
+	verbosity_flag = &flag_definition{
+		name:        "verbosity",
+		value:       strings.Join(verbosity_levels, "|"),
+		description: "How much to log to stderr (the default is error).",
+	}
+	help_flag = &flag_definition{
+		name:        "help",
+		aliases:     []string{"-h"},
+		description: "Show the help for the command instead of running it.",
+	}
+	hash_flag = &flag_definition{
+		name:        "hash",
+		value:       "sha256",
+		description: "Record a data-hash: for each member.",
+	}
+	compress_flag = &flag_definition{
+		name:        "compress",
+		value:       "gzip|zlib|flate",
+		description: "Compress the data of members that get smaller.",
+	}
+	align_flag = &flag_definition{
+		name:        "align",
+		value:       "N",
+		description: "Start the data of each member at a multiple of N bytes.",
+	}
+	transform_flag = &flag_definition{
+		name:        "transform",
+		value:       "s/regexp/replacement/",
+		description: "Rename members with sed style rules separated by \";\".",
+	}
+	strip_components_flag = &flag_definition{
+		name:        "strip-components",
+		value:       "N",
+		description: "Remove the first N directories from member names.",
+	}
+	verify_flag = &flag_definition{
+		name:        "verify",
+		description: "Check each member against its data-hash: before it is put in place.",
+	}
+	preserve_owner_flag = &flag_definition{
+		name:        "preserve-owner",
+		description: "Restore the owner and group of each member.",
+	}
+	numeric_owner_flag = &flag_definition{
+		name:        "numeric-owner",
+		description: "Restore owners by number even when their names exist.",
+	}
+	no_same_permissions_flag = &flag_definition{
+		name:        "no-same-permissions",
+		description: "Leave permissions to the umask instead of restoring them.",
+	}
+	allow_unsafe_paths_flag = &flag_definition{
+		name:        "allow-unsafe-paths",
+		description: "Extract members outside of the output directory instead of rejecting them.",
+	}
+	exclude_flag = &flag_definition{
+		name:        "exclude",
+		value:       "PATTERN",
+		repeatable:  true,
+		description: "Skip members matching PATTERN (which may be given more than once).",
+	}
+	where_flag = &flag_definition{
+		name:        "where",
+		value:       "EXPRESSION",
+		description: "Only select members whose headers match EXPRESSION (like 'size > 1MiB && file-name ~ \"\\.png$\"').",
+	}
+	format_flag = &flag_definition{
+		name:        "format",
+		value:       strings.Join(output_formats, "|"),
+		description: "Show members as text (the default), a JSON array, JSON Lines, or NUL terminated.",
+	}
+	long_flag = &flag_definition{
+		name:        "long",
+		aliases:     []string{"-l"},
+		description: "Show the mode, owner, size, time, type, compression ratio, hash, and name of each member.",
+	}
+	human_readable_flag = &flag_definition{
+		name:        "human-readable",
+		description: "Show sizes like 1.5K or 23M instead of in bytes.",
+	}
+	columns_flag = &flag_definition{
+		name:        "columns",
+		value:       "COLUMN,...",
+		description: "Show these columns (" + list_column_names() + ", or any header key) instead of the default ones (implies --long).",
+	}
+	sort_flag = &flag_definition{
+		name:        "sort",
+		value:       strings.Join(list_order_names, "|"),
+		description: "Sort the members (which are otherwise shown in the order they are in the archive).",
+	}
+	reverse_flag = &flag_definition{
+		name:        "reverse",
+		aliases:     []string{"-r"},
+		description: "Show the members in the reverse order.",
+	}
+	offset_flag = &flag_definition{
+		name:        "offset",
+		value:       "N",
+		description: "Skip the first N bytes of each member.",
+	}
+	length_flag = &flag_definition{
+		name:        "length",
+		value:       "N",
+		description: "Write at most N bytes of each member.",
+	}
+	separator_flag = &flag_definition{
+		name:        "separator",
+		value:       "STRING",
+		description: "Write STRING (which may have escapes like \\n or \\0) between members.",
+	}
+	jobs_flag = &flag_definition{
+		name:        "jobs",
+		aliases:     []string{"-j"},
+		value:       "N",
+		description: "Work on up to N members at once (with the same results as doing them one at a time).",
+	}
+	output_directory_flag = &flag_definition{
+		name:        "output-directory",
+		aliases:     []string{"--output-dir", "-C"},
+		value:       "DIR",
+		description: "Extract members into DIR (which is created if needed).",
+	}
+)
+
+// The flags every command understands.
+var global_flags = []*flag_definition{verbose_flag, verbosity_flag, help_flag}
+
+var writer_flags = []*flag_definition{hash_flag, compress_flag, align_flag}
+
+var extract_flags = []*flag_definition{
+	input_file_flag, exclude_flag, where_flag, verify_flag, preserve_owner_flag, numeric_owner_flag,
+	no_same_permissions_flag, allow_unsafe_paths_flag, overwrite_flag,
+	output_directory_flag, strip_components_flag, transform_flag, jobs_flag,
+}
+
+// Every command in the order they are shown in the help.
+var commands = []*command_definition{
+	{
+		name:        "create",
+		aliases:     []string{"c"},
+		arguments:   "files...",
+		description: "Create an archive from the given files (and everything in the given directories).",
+		flags:       append([]*flag_definition{output_file_flag, exclude_flag, transform_flag, jobs_flag}, writer_flags...),
+		run:         create_command,
+	},
+	{
+		name:        "list",
+		aliases:     []string{"l"},
+		arguments:   "[patterns...]",
+		description: "List the names (or more with --long) of the (matching) members in an archive.",
+		flags: []*flag_definition{
+			input_file_flag, exclude_flag, where_flag, long_flag, human_readable_flag, columns_flag,
+			sort_flag, reverse_flag, format_flag,
+		},
+		run: list_command,
+	},
+	{
+		name:        "headers",
+		arguments:   "[patterns...]",
+		description: "Show the complete headers of the (matching) members in an archive.",
+		flags:       []*flag_definition{input_file_flag, exclude_flag, where_flag, format_flag},
+		run:         headers_command,
+	},
+	{
+		name:        "extract",
+		aliases:     []string{"x"},
+		arguments:   "[patterns...]",
+		description: "Extract the matching members (or all of them) from an archive.",
+		flags:       extract_flags,
+		run:         extract_command,
+	},
+	{
+		name:        "extract-by-file-name",
+		arguments:   "members...",
+		description: "Extract the given members which must all be in the archive.",
+		flags:       extract_flags,
+		run:         extract_by_file_name_command,
+	},
+	{
+		name:        "cat",
+		arguments:   "[patterns...]",
+		description: "Write the data of the matching members (or all of them) to stdout.",
+		flags: []*flag_definition{
+			input_file_flag, exclude_flag, where_flag, offset_flag, length_flag, separator_flag,
+		},
+		run: cat_command,
+	},
+	{
+		name:        "join",
+		arguments:   "archives...",
+		description: "Write all of the members of the given archives to a single archive.",
+		flags:       append([]*flag_definition{output_file_flag}, writer_flags...),
+		run:         join_command,
+	},
+	{
+		name:        "append",
+		arguments:   "files...",
+		description: "Copy an archive and add the given files (and everything in the given directories) to it.",
+		flags: append([]*flag_definition{
+			input_file_flag, output_file_flag, exclude_flag, transform_flag, jobs_flag,
+		}, writer_flags...),
+		run: append_command,
+	},
+	{
+		name:        "remove",
+		arguments:   "patterns...",
+		description: "Copy an archive without the matching members.",
+		flags:       []*flag_definition{input_file_flag, output_file_flag, exclude_flag, where_flag},
+		run:         remove_command,
+	},
+	{
+		name:        "export",
+		arguments:   "[patterns...]",
+		description: "Copy the matching members of an archive to a new archive.",
+		flags:       []*flag_definition{input_file_flag, output_file_flag, exclude_flag, where_flag},
+		run:         export_command,
+	},
+	{
+		name:        "remove-by-file-name",
+		arguments:   "members...",
+		description: "Copy an archive without the given members which must all be in the archive.",
+		flags:       []*flag_definition{input_file_flag, output_file_flag, exclude_flag, where_flag},
+		run:         remove_by_file_name_command,
+	},
+	{
+		name:        "verify",
+		arguments:   "[patterns...]",
+		description: "Check the matching members (or all of them) against their data-hash:.",
+		flags:       []*flag_definition{input_file_flag, exclude_flag, where_flag},
+		run:         verify_command,
+	},
+}
+
+// Find a command by its name or one of its aliases.
+func find_command(name string) *command_definition {
+	for _, command := range commands {
+		if command.name == name || slices.Contains(command.aliases, name) {
+			return command
+		}
+	}
+	return nil
+}
+
+// Find one of the flags a command understands by "--name" or one of
+// its aliases.
+func (command *command_definition) find_flag(spelling string) *flag_definition {
+	for _, flags := range [][]*flag_definition{command.flags, global_flags} {
+		for _, flag := range flags {
+			if spelling == "--"+flag.name || slices.Contains(flag.aliases, spelling) {
+				return flag
+			}
+		}
+	}
+	return nil
+}
+
+// Split the flags for a command from its other arguments. Flags may
+// be mixed with the other arguments until a "--" argument (a lone
+// "-" is not a flag since it means stdin or stdout). The flags are
+// returned by their names (so aliases are never seen by the
+// commands) with "true" or "false" as the value of boolean flags.
+// Only the last value of a flag counts unless it is repeatable.
+func parse_flags(command *command_definition, args []string) (map[string]string, []string, error) {
+	flags := make(map[string]string)
+	rest := []string{}
+	for len(args) > 0 {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			rest = append(rest, args...)
+			break
+		}
+		if arg == "-" || !strings.HasPrefix(arg, "-") {
+			rest = append(rest, arg)
+			continue
+		}
+		spelling, value, has_value := strings.Cut(arg, "=")
+		flag := command.find_flag(spelling)
+		if flag == nil {
+			return nil, nil, usage_error(command.name + " doesn't understand " + spelling)
+		}
+		if flag.value == "" {
+			if !has_value {
+				value = "true"
+			}
+			boolean, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, nil, usage_error(fmt.Sprintf("%s must be true or false", spelling))
+			}
+			value = strconv.FormatBool(boolean)
+		} else if !has_value {
+			if len(args) == 0 {
+				return nil, nil, usage_error(spelling + " needs a value")
+			}
+			value = args[0]
+			args = args[1:]
+		}
+		if previous, ok := flags[flag.name]; ok && flag.repeatable {
+			value = previous + "\x00" + value
+		}
+		flags[flag.name] = value
+	}
+	return flags, rest, nil
+}
+
+// Returns every value given for a repeatable flag (in order).
+func flag_values(flags map[string]string, name string) []string {
+	value, ok := flags[name]
+	if !ok {
+		return nil
+	}
+	return strings.Split(value, "\x00")
+}
+
+// Show the help for every command (followed by the exit statuses).
+func usage(output io.Writer) {
+	fmt.Fprintln(output, "Usage: core-archive-command COMMAND [flags] [arguments]")
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "core-archive-command can create, list, extract, and join archives in the")
+	fmt.Fprintln(output, "omni archive format. An archive of \"-\" means stdin or stdout.")
+	for _, command := range commands {
+		fmt.Fprintln(output)
+		command_usage(output, command)
+	}
+	fmt.Fprintln(output)
+	fmt.Fprintln(output, "Flags for every command:")
+	flags_usage(output, global_flags)
+	fmt.Fprintln(output)
+	exit_status_usage(output)
+}
+
+// Show the help for a single command.
+func command_usage(output io.Writer, command *command_definition) {
+	fmt.Fprintf(output, "core-archive-command %s [flags] %s\n", command.name, command.arguments)
+	if len(command.aliases) > 0 {
+		fmt.Fprintf(output, "  (or %s)\n", strings.Join(command.aliases, ", "))
+	}
+	fmt.Fprintf(output, "  %s\n", command.description)
+	flags_usage(output, command.flags)
+}
+
+func flags_usage(output io.Writer, flags []*flag_definition) {
+	for _, flag := range flags {
+		spelling := "--" + flag.name
+		if flag.value != "" {
+			spelling += "=" + flag.value
+		}
+		if len(flag.aliases) > 0 {
+			spelling += " (or " + strings.Join(flag.aliases, ", ") + ")"
+		}
+		fmt.Fprintf(output, "    %s\n        %s\n", spelling, flag.description)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"io/fs"
+)
+
+type file_identity struct{}
+
+// Hard links are only detected on unix like systems.
+func hard_link_identity(info fs.FileInfo) (file_identity, bool) {
+	return file_identity{}, false
+}
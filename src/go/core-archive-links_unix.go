@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// Files with the same identity are hard links to each other.
+type file_identity struct {
+	device uint64
+	inode  uint64
+}
+
+// Returns the identity of a file that has more than one hard link.
+func hard_link_identity(info fs.FileInfo) (file_identity, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return file_identity{}, false
+	}
+	return file_identity{uint64(stat.Dev), uint64(stat.Ino)}, true
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jasonaaronwilson/omni-archive/src/go/corearchive"
+)
+
+// A column of "list --long". Columns that aren't one of these show
+// the value of the header key with the same name.
+type list_column struct {
+	name string
+	// Numbers are lined up on the right.
+	right_aligned bool
+	value         func(header corearchive.Header, options list_options) string
+}
+
+type list_options struct {
+	human_readable bool
+}
+
+var list_columns = []list_column{
+	{"mode", false, list_mode},
+	{"owner", false, list_owner},
+	{"size", true, list_size},
+	{"stored", true, list_stored_size},
+	{"offset", true, list_offset},
+	{"mtime", false, list_modification_time},
+	{"type", false, list_file_type},
+	{"ratio", true, list_ratio},
+	{"hash", false, list_hash},
+	{"name", false, list_name},
+}
+
+// The columns shown by --long without --columns (which is like "tar
+// tvf" with a few more columns).
+var default_list_columns = []string{"mode", "owner", "size", "mtime", "type", "ratio", "hash", "name"}
+
+// How --sort orders members.
+var list_orders = map[string]func(a, b corearchive.Header) int{
+	"name": func(a, b corearchive.Header) int {
+		return strings.Compare(a[corearchive.FILE_NAME_KEY], b[corearchive.FILE_NAME_KEY])
+	},
+	"size": func(a, b corearchive.Header) int {
+		a_size, _ := a.DataSize()
+		b_size, _ := b.DataSize()
+		return cmp.Compare(a_size, b_size)
+	},
+	"offset": func(a, b corearchive.Header) int {
+		a_start, _ := a.Start()
+		b_start, _ := b.Start()
+		return cmp.Compare(a_start, b_start)
+	},
+	"time": func(a, b corearchive.Header) int {
+		a_time, _ := a.ModTime()
+		b_time, _ := b.ModTime()
+		return a_time.Compare(b_time)
+	},
+}
+
+var list_order_names = []string{"name", "size", "offset", "time"}
+
+// The values of --format for list and headers. text is meant to be
+// read by people and the others by programs (null separates names or
+// header lines with NUL bytes just like the archive format does).
+const (
+	FORMAT_TEXT  = "text"
+	FORMAT_JSON  = "json"
+	FORMAT_JSONL = "jsonl"
+	FORMAT_NULL  = "null"
+)
+
+var output_formats = []string{FORMAT_TEXT, FORMAT_JSON, FORMAT_JSONL, FORMAT_NULL}
+
+// What --format=json and --format=jsonl show for each member: every
+// key of the header (without its ":") along with the values computed
+// from them. offset and end (where the data is in the archive) are
+// null for members without a start:.
+type member_json struct {
+	Offset     *int64            `json:"offset"`
+	End        *int64            `json:"end"`
+	Size       int64             `json:"size"`
+	DataSize   int64             `json:"data-size"`
+	FileType   string            `json:"file-type"`
+	Compressed bool              `json:"compressed"`
+	Header     map[string]string `json:"header"`
+}
+
+// Read all headers and display the file names contained in a very
+// succinct format (or one line per member with --long).
+func list_command(flags map[string]string, args []string) error {
+	selector, err := new_member_selector(flags, args)
+	if err != nil {
+		return err
+	}
+	format, err := parse_output_format(flags)
+	if err != nil {
+		return err
+	}
+	columns, err := parse_list_columns(flags)
+	if err != nil {
+		return err
+	}
+	if columns != nil && format != FORMAT_TEXT {
+		return usage_error("--long and --columns only work with --format=" + FORMAT_TEXT)
+	}
+	order, has_order := list_orders[flags["sort"]]
+	if _, ok := flags["sort"]; ok && !has_order {
+		return usage_error("--sort must be one of " + strings.Join(list_order_names, ", "))
+	}
+	options := list_options{human_readable: flags["human-readable"] == "true"}
+	return with_input_archive(flags,
+		func(archive *corearchive.Reader) error {
+			// Only sorting needs every member at once.
+			members := selector.members(archive)
+			if has_order || flags["reverse"] == "true" {
+				headers, err := selector.select_members(archive)
+				if err != nil {
+					return err
+				}
+				if has_order {
+					slices.SortStableFunc(headers, order)
+				}
+				if flags["reverse"] == "true" {
+					slices.Reverse(headers)
+				}
+				members = all_headers(headers)
+			}
+			output := bufio.NewWriter(os.Stdout)
+			switch {
+			case format == FORMAT_JSON || format == FORMAT_JSONL:
+				err = write_json_members(output, format, members)
+			case columns != nil:
+				err = write_list_table(output, columns, members, options)
+			default:
+				terminator := "\n"
+				if format == FORMAT_NULL {
+					terminator = "\x00"
+				}
+				err = each_member(members, func(header corearchive.Header) error {
+					if header.Has(corearchive.FILE_NAME_KEY) {
+						output.WriteString(header[corearchive.FILE_NAME_KEY] + terminator)
+					}
+					return nil
+				})
+			}
+			if err != nil {
+				return err
+			}
+			return output.Flush()
+		})
+}
+
+// Read all headers and then display them in a human readable format
+// (or as JSON or exactly as they are written in the archive with
+// --format).
+func headers_command(flags map[string]string, args []string) error {
+	selector, err := new_member_selector(flags, args)
+	if err != nil {
+		return err
+	}
+	format, err := parse_output_format(flags)
+	if err != nil {
+		return err
+	}
+	return with_input_archive(flags,
+		func(archive *corearchive.Reader) error {
+			members := selector.members(archive)
+			output := bufio.NewWriter(os.Stdout)
+			switch format {
+			case FORMAT_JSON, FORMAT_JSONL:
+				err = write_json_members(output, format, members)
+			case FORMAT_NULL:
+				err = each_member(members, func(header corearchive.Header) error {
+					_, err := output.Write(header.Bytes())
+					return err
+				})
+			default:
+				err = each_member(members, func(header corearchive.Header) error {
+					_, err := fmt.Fprintln(output, header.String())
+					return err
+				})
+			}
+			if err != nil {
+				return err
+			}
+			return output.Flush()
+		})
+}
+
+func parse_output_format(flags map[string]string) (string, error) {
+	format, ok := flags["format"]
+	if !ok {
+		return FORMAT_TEXT, nil
+	}
+	if !slices.Contains(output_formats, format) {
+		return "", usage_error("--format must be one of " + strings.Join(output_formats, ", "))
+	}
+	return format, nil
+}
+
+// Write the members as a JSON array (with one member per line) or
+// as JSON Lines.
+func write_json_members(output io.Writer, format string, members iter.Seq2[corearchive.Header, error]) error {
+	count := 0
+	err := each_member(members, func(header corearchive.Header) error {
+		bytes, err := json.Marshal(new_member_json(header))
+		if err != nil {
+			return err
+		}
+		line := "%s\n"
+		if format == FORMAT_JSON && count == 0 {
+			line = "[\n%s"
+		} else if format == FORMAT_JSON {
+			line = ",\n%s"
+		}
+		count++
+		_, err = fmt.Fprintf(output, line, bytes)
+		return err
+	})
+	if err != nil || format != FORMAT_JSON {
+		return err
+	}
+	end := "\n]\n"
+	if count == 0 {
+		end = "[]\n"
+	}
+	_, err = io.WriteString(output, end)
+	return err
+}
+
+func new_member_json(header corearchive.Header) member_json {
+	result := member_json{
+		FileType:   header.FileType(),
+		Compressed: header.IsCompressed(),
+		Header:     make(map[string]string),
+	}
+	// The reader has already checked size:, start:, and data-size:.
+	result.Size, _ = header.Size()
+	result.DataSize, _ = header.DataSize()
+	if header.Has(corearchive.START_KEY) {
+		start, _ := header.Start()
+		end := start + result.Size
+		result.Offset, result.End = &start, &end
+	}
+	for key, value := range header {
+		result.Header[strings.TrimSuffix(key, ":")] = value
+	}
+	return result
+}
+
+// The columns to show for --long or --columns (or nil for just the
+// names).
+func parse_list_columns(flags map[string]string) ([]list_column, error) {
+	names := default_list_columns
+	if value, ok := flags["columns"]; ok {
+		names = strings.Split(value, ",")
+	} else if flags["long"] != "true" {
+		return nil, nil
+	}
+	columns := []list_column{}
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.TrimSpace(name), ":")
+		if name == "" {
+			return nil, usage_error("bad --columns " + flags["columns"])
+		}
+		index := slices.IndexFunc(list_columns, func(column list_column) bool {
+			return column.name == name
+		})
+		if index >= 0 {
+			columns = append(columns, list_columns[index])
+			continue
+		}
+		key := name + ":"
+		columns = append(columns, list_column{name, false, func(header corearchive.Header, options list_options) string {
+			return or_dash(header[key])
+		}})
+	}
+	return columns, nil
+}
+
+// Write one line per member with the columns padded to line up (except
+// for the last one so that names aren't followed by spaces).
+//
+// The members are gone through twice (once to find the widths of the
+// columns) rather than holding all of them in memory.
+func write_list_table(output io.Writer, columns []list_column, members iter.Seq2[corearchive.Header, error], options list_options) error {
+	widths := make([]int, len(columns))
+	err := each_member(members, func(header corearchive.Header) error {
+		for i, column := range columns {
+			widths[i] = max(widths[i], utf8.RuneCountInString(column.value(header, options)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return each_member(members, func(header corearchive.Header) error {
+		line := strings.Builder{}
+		for i, column := range columns {
+			value := column.value(header, options)
+			if i > 0 {
+				line.WriteString(" ")
+			}
+			padding := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(value))
+			switch {
+			case column.right_aligned:
+				line.WriteString(padding + value)
+			case i == len(columns)-1:
+				line.WriteString(value)
+			default:
+				line.WriteString(value + padding)
+			}
+		}
+		_, err := fmt.Fprintln(output, line.String())
+		return err
+	})
+}
+
+// The posix-file-mode: of a member or (when it doesn't have one) the
+// type character of its file-type: with "?" for the permissions.
+func list_mode(header corearchive.Header, options list_options) string {
+	if header.Has(corearchive.POSIX_FILE_MODE_KEY) {
+		return header[corearchive.POSIX_FILE_MODE_KEY]
+	}
+	mode, ok := corearchive.FileTypeMode(header.FileType())
+	if !ok {
+		return "??????????"
+	}
+	return corearchive.FormatFileMode(mode)[:1] + "?????????"
+}
+
+// The owner and group names (or numbers when the names weren't
+// recorded) like "tar tvf" shows them.
+func list_owner(header corearchive.Header, options list_options) string {
+	if !header.Has(corearchive.POSIX_OWNER_NAME_KEY) && !header.Has(corearchive.POSIX_OWNER_NUMBER_KEY) &&
+		!header.Has(corearchive.POSIX_GROUP_NAME_KEY) && !header.Has(corearchive.POSIX_GROUP_NUMBER_KEY) {
+		return "-"
+	}
+	owner, group, _ := header.Owner()
+	return list_id(header[corearchive.POSIX_OWNER_NAME_KEY], owner) + "/" +
+		list_id(header[corearchive.POSIX_GROUP_NAME_KEY], group)
+}
+
+func list_id(name string, number int) string {
+	if name != "" {
+		return name
+	}
+	if number >= 0 {
+		return strconv.Itoa(number)
+	}
+	return "-"
+}
+
+// The size of the data once it is decompressed.
+func list_size(header corearchive.Header, options list_options) string {
+	size, err := header.DataSize()
+	if err != nil {
+		return "?"
+	}
+	return format_list_size(size, options)
+}
+
+// The size of the data as it is stored in the archive.
+func list_stored_size(header corearchive.Header, options list_options) string {
+	size, err := header.Size()
+	if err != nil {
+		return "?"
+	}
+	return format_list_size(size, options)
+}
+
+func list_offset(header corearchive.Header, options list_options) string {
+	if !header.Has(corearchive.START_KEY) {
+		return "-"
+	}
+	start, err := header.Start()
+	if err != nil {
+		return "?"
+	}
+	return strconv.FormatInt(start, 10)
+}
+
+// Times are shown in the local time zone (like "tar tvf").
+func list_modification_time(header corearchive.Header, options list_options) string {
+	if !header.Has(corearchive.POSIX_MODIFICATION_TIME_SECONDS_KEY) {
+		return "-"
+	}
+	modification_time, err := header.ModTime()
+	if err != nil {
+		return "?"
+	}
+	return modification_time.Local().Format(time.DateOnly + " 15:04")
+}
+
+func list_file_type(header corearchive.Header, options list_options) string {
+	return header.FileType()
+}
+
+// How big the stored data is compared to the original data (only for
+// compressed members).
+func list_ratio(header corearchive.Header, options list_options) string {
+	if !header.IsCompressed() {
+		return "-"
+	}
+	stored, err := header.Size()
+	if err != nil {
+		return "?"
+	}
+	size, err := header.DataSize()
+	if err != nil {
+		return "?"
+	}
+	if size == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d%%", stored*100/size)
+}
+
+// Enough of the data-hash: to tell members apart.
+func list_hash(header corearchive.Header, options list_options) string {
+	hash := header[corearchive.DATA_HASH_KEY]
+	return or_dash(hash[:min(len(hash), 8)])
+}
+
+// The file-name: along with where links point.
+func list_name(header corearchive.Header, options list_options) string {
+	name := or_dash(header[corearchive.FILE_NAME_KEY])
+	switch header.FileType() {
+	case corearchive.FILE_TYPE_SYMBOLIC_LINK:
+		return name + " -> " + header[corearchive.LINK_TARGET_KEY]
+	case corearchive.FILE_TYPE_HARD_LINK:
+		return name + " link to " + header[corearchive.LINK_TARGET_KEY]
+	}
+	return name
+}
+
+// Sizes are shown in bytes or (with --human-readable) like "ls -lh"
+// shows them (for example "1.5K" or "23M").
+func format_list_size(size int64, options list_options) string {
+	if !options.human_readable || size < 1024 {
+		return strconv.FormatInt(size, 10)
+	}
+	// Whatever rounds up to 1024 is shown in the next unit (so
+	// 1048575 is "1.0M" rather than "1024K").
+	value := float64(size)
+	unit := 0
+	for unit == 0 || (math.Round(value) >= 1024 && unit < len("KMGTPE")) {
+		value /= 1024
+		unit++
+	}
+	if math.Round(value*10) < 100 {
+		return fmt.Sprintf("%.1f%c", value, "KMGTPE"[unit-1])
+	}
+	return fmt.Sprintf("%.0f%c", value, "KMGTPE"[unit-1])
+}
+
+func or_dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// The names of the columns for the help.
+func list_column_names() string {
+	names := []string{}
+	for _, column := range list_columns {
+		names = append(names, column.name)
+	}
+	return strings.Join(names, ", ")
+}
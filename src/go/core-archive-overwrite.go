@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/jasonaaronwilson/omni-archive/src/go/corearchive"
+)
+
+// The values of --overwrite (the first three are the same as the C
+// oarchive).
+const (
+	OVERWRITE_NO         = "no"
+	OVERWRITE_YES        = "yes"
+	OVERWRITE_ASK        = "ask"
+	OVERWRITE_KEEP_NEWER = "keep-newer"
+	OVERWRITE_RENAME     = "rename"
+)
+
+var overwrite_values = []string{
+	OVERWRITE_NO, OVERWRITE_YES, OVERWRITE_ASK, OVERWRITE_KEEP_NEWER, OVERWRITE_RENAME,
+}
+
+// Decide what to do about a member that is going to be extracted as
+// filename according to --overwrite. Returns the name to extract it
+// as (which is empty when it shouldn't be extracted at all) and a
+// description of what is being done for the log.
+//
+// With keep-newer, members without a modification time are never
+// considered newer than an existing file.
+func (extractor *extractor) choose_output_name(header corearchive.Header, filename string) (string, string, error) {
+	existing, err := extractor.output.Lstat(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return filename, "created", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	switch extractor.options.overwrite {
+	case OVERWRITE_YES:
+		return filename, "overwritten", nil
+	case OVERWRITE_ASK:
+		if extractor.ask(fmt.Sprintf("overwrite %s?", filename)) {
+			return filename, "overwritten", nil
+		}
+		return "", "skipped", nil
+	case OVERWRITE_KEEP_NEWER:
+		modification_time, err := header.ModTime()
+		if err != nil {
+			return "", "", err
+		}
+		if !modification_time.IsZero() && modification_time.After(existing.ModTime()) {
+			return filename, "overwritten (older than the archive)", nil
+		}
+		return "", "kept (not older than the archive)", nil
+	case OVERWRITE_RENAME:
+		for i := 1; ; i++ {
+			candidate := fmt.Sprintf("%s.%d", filename, i)
+			if _, err := extractor.output.Lstat(candidate); errors.Is(err, fs.ErrNotExist) {
+				return candidate, "renamed to " + candidate, nil
+			} else if err != nil {
+				return "", "", err
+			}
+		}
+	}
+	extractor.not_overwritten++
+	return "", "not overwritten (already exists)", nil
+}
+
+// The answers for --overwrite=ask are read from stdin so the archive
+// can't be.
+func check_answers_source(archive_name string, options extract_options) error {
+	if options.overwrite == OVERWRITE_ASK && archive_name == "-" {
+		return usage_error("--overwrite=ask needs --input-file since the answers are read from stdin")
+	}
+	return nil
+}
+
+// Ask a yes or no question on stderr. Anything but "y" or "yes" (or
+// not being able to read an answer at all) means no.
+func (extractor *extractor) ask(question string) bool {
+	if extractor.answers == nil {
+		extractor.answers = bufio.NewReader(os.Stdin)
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, err := extractor.answers.ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Fprintln(os.Stderr)
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
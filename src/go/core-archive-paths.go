@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A member would be extracted outside of the output directory.
+var ErrUnsafePath = errors.New("unsafe path")
+
+// Where members are extracted to. Normally this is an *os.Root which
+// resolves every name one directory at a time (with openat() and
+// friends) so that nothing, not even a symbolic link created by a
+// racing process, can lead outside of the directory.
+type output_directory interface {
+	Chmod(name string, mode fs.FileMode) error
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+	Lchown(name string, uid, gid int) error
+	Link(oldname, newname string) error
+	Lstat(name string) (fs.FileInfo, error)
+	MkdirAll(name string, perm fs.FileMode) error
+	Open(name string) (*os.File, error)
+	OpenFile(name string, flag int, perm fs.FileMode) (*os.File, error)
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	Symlink(oldname, newname string) error
+	Close() error
+}
+
+// Open the directory members are extracted to. With
+// --allow-unsafe-paths names are used as is (so absolute names and
+// ".." work just like they do for any other command).
+func open_output_directory(name string, allow_unsafe_paths bool) (output_directory, error) {
+	if allow_unsafe_paths {
+		return unconfined_directory(name), nil
+	}
+	return os.OpenRoot(name)
+}
+
+// Returns an error wrapping ErrUnsafePath if a name read from an
+// archive could refer to something outside of the output directory
+// (without even looking at the file system).
+func check_member_path(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: empty file-name", ErrUnsafePath)
+	}
+	for _, part := range strings.FieldsFunc(name, is_separator) {
+		if part == ".." {
+			return fmt.Errorf("%w: %q contains \"..\"", ErrUnsafePath, name)
+		}
+	}
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("%w: %q is not a relative path", ErrUnsafePath, name)
+	}
+	return nil
+}
+
+func is_separator(character rune) bool {
+	return character == '/' || os.IsPathSeparator(uint8(character))
+}
+
+// Returns an error wrapping ErrUnsafePath if one of the parent
+// directories of name is a symbolic link. (Even one that stays inside
+// of the output directory could be changed by a later member).
+func check_parent_directories(directory output_directory, name string) error {
+	parent := filepath.Dir(name)
+	parents := []string{}
+	for parent != "." && parent != string(filepath.Separator) {
+		parents = append(parents, parent)
+		parent = filepath.Dir(parent)
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		info, err := directory.Lstat(parents[i])
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %q is inside of the symbolic link %q", ErrUnsafePath, name, parents[i])
+		}
+	}
+	return nil
+}
+
+// The output directory for --allow-unsafe-paths which only uses the
+// directory for relative names.
+type unconfined_directory string
+
+func (directory unconfined_directory) path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(string(directory), name)
+}
+
+func (directory unconfined_directory) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(directory.path(name), mode)
+}
+
+func (directory unconfined_directory) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(directory.path(name), atime, mtime)
+}
+
+func (directory unconfined_directory) Lchown(name string, uid, gid int) error {
+	return os.Lchown(directory.path(name), uid, gid)
+}
+
+func (directory unconfined_directory) Link(oldname, newname string) error {
+	return os.Link(directory.path(oldname), directory.path(newname))
+}
+
+func (directory unconfined_directory) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(directory.path(name))
+}
+
+func (directory unconfined_directory) MkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(directory.path(name), perm)
+}
+
+func (directory unconfined_directory) Open(name string) (*os.File, error) {
+	return os.Open(directory.path(name))
+}
+
+func (directory unconfined_directory) OpenFile(name string, flag int, perm fs.FileMode) (*os.File, error) {
+	return os.OpenFile(directory.path(name), flag, perm)
+}
+
+func (directory unconfined_directory) Remove(name string) error {
+	return os.Remove(directory.path(name))
+}
+
+func (directory unconfined_directory) Rename(oldname, newname string) error {
+	return os.Rename(directory.path(oldname), directory.path(newname))
+}
+
+// The target of a symbolic link is just some text (so it isn't
+// touched).
+func (directory unconfined_directory) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, directory.path(newname))
+}
+
+func (directory unconfined_directory) Close() error {
+	return nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"iter"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/jasonaaronwilson/omni-archive/src/go/corearchive"
+)
+
+// Which members a command works on. With no patterns every member is
+// selected. Otherwise a member is selected when at least one of the
+// patterns matches its file-name: and none of the --exclude patterns
+// do.
+//
+// Patterns are globs where "*" and "?" never match "/", "**" matches
+// any number of directories, "[...]" matches a set of characters and
+// "{a,b}" matches either alternative. A pattern that matches a
+// directory also matches everything inside of it (so "src" selects
+// "src/main.go"). Exclude patterns without a "/" may match any part
+// of a name (so "*.o" excludes "lib/x.o"). On top of that, --where
+// only selects the members whose headers it is true for.
+//
+// Patterns without any special characters (and the names given to
+// the "-by-file-name" commands) are looked up by name rather than
+// matched against every member so selecting a few members out of
+// millions doesn't take millions of matches per member. When all of
+// the patterns are like that, only the members with those names (or
+// inside of those directories) are read (see Reader.FindAll).
+type member_selector struct {
+	// Every pattern in the order they were given.
+	patterns []*member_pattern
+	// The patterns with special characters.
+	globs []*member_pattern
+	// The other patterns by the name they match (which may be a
+	// directory) and the exact patterns by their text.
+	literals map[string][]*member_pattern
+	exact    map[string][]*member_pattern
+	excludes []*member_pattern
+	where    where_expression
+
+	// The members check_patterns selected (when there were few
+	// enough to keep) so members doesn't have to read every header
+	// again.
+	selected         []corearchive.Header
+	selected_archive *corearchive.Reader
+}
+
+// The most selected headers check_patterns keeps in memory.
+const MAX_SELECTED_IN_MEMORY = 4096
+
+type member_pattern struct {
+	text string
+	// Each alternative (after expanding "{...}") split at "/".
+	alternatives [][]string
+	// Only matches a member with exactly this name.
+	exact bool
+	// Whether any member was selected by this pattern.
+	used bool
+}
+
+// Create a selector for the patterns given as the arguments of a
+// command and its --exclude and --where flags.
+func new_member_selector(flags map[string]string, patterns []string) (*member_selector, error) {
+	selector := &member_selector{
+		literals: make(map[string][]*member_pattern),
+		exact:    make(map[string][]*member_pattern),
+	}
+	if text, ok := flags["where"]; ok {
+		where, err := parse_where(text)
+		if err != nil {
+			return nil, usage_error(fmt.Sprintf("bad --where %q: %v", text, err))
+		}
+		selector.where = where
+	}
+	for _, text := range patterns {
+		pattern, err := compile_member_pattern(text, true)
+		if err != nil {
+			return nil, err
+		}
+		selector.add(pattern)
+	}
+	for _, text := range flag_values(flags, "exclude") {
+		pattern, err := compile_member_pattern(text, strings.Contains(strings.Trim(text, "/"), "/"))
+		if err != nil {
+			return nil, err
+		}
+		selector.excludes = append(selector.excludes, pattern)
+	}
+	return selector, nil
+}
+
+// Like new_member_selector but the names are only ever compared
+// exactly with file-name: values (for the "-by-file-name" commands).
+func new_exact_member_selector(flags map[string]string, names []string) (*member_selector, error) {
+	selector, err := new_member_selector(flags, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		selector.add(&member_pattern{text: name, exact: true})
+	}
+	return selector, nil
+}
+
+func (selector *member_selector) add(pattern *member_pattern) {
+	selector.patterns = append(selector.patterns, pattern)
+	switch {
+	case pattern.exact:
+		selector.exact[pattern.text] = append(selector.exact[pattern.text], pattern)
+	case len(pattern.alternatives) == 1 && !strings.ContainsAny(pattern.text, "*?[\\"):
+		name := strings.Join(pattern.alternatives[0], "/")
+		selector.literals[name] = append(selector.literals[name], pattern)
+	default:
+		selector.globs = append(selector.globs, pattern)
+	}
+}
+
+// An anchored pattern has to match from the start of a name.
+func compile_member_pattern(text string, anchored bool) (*member_pattern, error) {
+	pattern := &member_pattern{text: text}
+	for _, alternative := range expand_braces(text) {
+		alternative = strings.Trim(strings.TrimPrefix(alternative, "./"), "/")
+		parts := strings.Split(alternative, "/")
+		for _, part := range parts {
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, usage_error(fmt.Sprintf("bad pattern %q", text))
+			}
+		}
+		if !anchored {
+			parts = append([]string{"**"}, parts...)
+		}
+		pattern.alternatives = append(pattern.alternatives, parts)
+	}
+	return pattern, nil
+}
+
+// Expand the first (outermost) "{a,b,...}" in a pattern and then
+// whatever is left. Unbalanced braces are left alone (so they only
+// match themselves).
+func expand_braces(pattern string) []string {
+	open, depth := -1, 0
+	alternatives := []string{}
+	last := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '{':
+			if depth == 0 {
+				open, last = i, i+1
+			}
+			depth++
+		case ',':
+			if depth == 1 {
+				alternatives = append(alternatives, pattern[last:i])
+				last = i + 1
+			}
+		case '}':
+			if depth == 0 {
+				continue
+			}
+			depth--
+			if depth > 0 {
+				continue
+			}
+			alternatives = append(alternatives, pattern[last:i])
+			result := []string{}
+			for _, alternative := range alternatives {
+				result = append(result, expand_braces(pattern[:open]+alternative+pattern[i+1:])...)
+			}
+			return result
+		}
+	}
+	return []string{pattern}
+}
+
+// Whether the pattern matches name (or one of its parent directories
+// unless the pattern is exact).
+func (pattern *member_pattern) matches(name string) bool {
+	if pattern.exact {
+		return name == pattern.text
+	}
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	for _, alternative := range pattern.alternatives {
+		if match_parts(alternative, parts) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match the "/" separated parts of a pattern with the parts of a name
+// allowing the name to have parts left over.
+func match_parts(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if match_parts(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	matched, _ := path.Match(pattern[0], name[0])
+	return matched && match_parts(pattern[1:], name[1:])
+}
+
+// Whether one of the --exclude patterns matches name.
+func (selector *member_selector) excluded(name string) bool {
+	for _, pattern := range selector.excludes {
+		if pattern.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Members without a file-name: are only selected when there are no
+// patterns. A pattern counts as used even when --where then rejects
+// what it matched.
+func (selector *member_selector) matches(header corearchive.Header) bool {
+	name, has_name := header[corearchive.FILE_NAME_KEY]
+	if !has_name {
+		return len(selector.patterns) == 0 && selector.where_matches(header)
+	}
+	if selector.excluded(name) {
+		return false
+	}
+	selected := len(selector.patterns) == 0
+	if selector.use_literals(name) {
+		selected = true
+	}
+	for _, pattern := range selector.globs {
+		if pattern.matches(name) {
+			pattern.used = true
+			selected = true
+		}
+	}
+	return selected && selector.where_matches(header)
+}
+
+// Mark the exact patterns for name and the literal patterns for name
+// or any of its parent directories as used (returning true if there
+// were any).
+func (selector *member_selector) use_literals(name string) bool {
+	used := false
+	use := func(patterns []*member_pattern) {
+		for _, pattern := range patterns {
+			pattern.used = true
+			used = true
+		}
+	}
+	use(selector.exact[name])
+	if len(selector.literals) > 0 {
+		parts := strings.Split(strings.Trim(name, "/"), "/")
+		for i := range parts {
+			use(selector.literals[strings.Join(parts[:i+1], "/")])
+		}
+	}
+	return used
+}
+
+func (selector *member_selector) where_matches(header corearchive.Header) bool {
+	return selector.where == nil || selector.where.evaluate(header)
+}
+
+// Returns an iterator over the selected members of an archive (in
+// the order they are in the archive). When there are patterns, the
+// headers are first read once to check that every pattern matches a
+// member so that nothing is done when there is a typo (it isn't an
+// error for --where to reject every member though). The selected
+// members are then usually already in memory. Otherwise only one
+// header is held at a time for a lazy archive. An archive read from a
+// pipe only spools the data of the selected members.
+func (selector *member_selector) members(archive *corearchive.Reader) iter.Seq2[corearchive.Header, error] {
+	return func(yield func(corearchive.Header, error) bool) {
+		if err := selector.check_patterns(archive); err != nil {
+			yield(nil, err)
+			return
+		}
+		archive.PlanReads(selector.matches, false)
+		if selector.selected_archive == archive {
+			for _, header := range selector.selected {
+				if !yield(header, nil) {
+					return
+				}
+			}
+			return
+		}
+		for header, err := range selector.candidates(archive) {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if selector.matches(header) && !yield(header, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Returns an error (wrapping ErrMemberNotFound) for the first pattern
+// that doesn't match any member of the archive. Up to
+// MAX_SELECTED_IN_MEMORY selected members are kept for members.
+func (selector *member_selector) check_patterns(archive *corearchive.Reader) error {
+	unused := func(pattern *member_pattern) bool {
+		return !pattern.used
+	}
+	// Nothing needs to be checked again once every pattern has
+	// been used.
+	if !slices.ContainsFunc(selector.patterns, unused) {
+		return nil
+	}
+	selected := []corearchive.Header{}
+	for header, err := range selector.candidates(archive) {
+		if err != nil {
+			return err
+		}
+		if selector.matches(header) && selected != nil {
+			selected = append(selected, header)
+			if len(selected) > MAX_SELECTED_IN_MEMORY {
+				selected = nil
+			}
+		}
+	}
+	if selected != nil {
+		selector.selected, selector.selected_archive = selected, archive
+	}
+	for _, pattern := range selector.patterns {
+		if !pattern.used {
+			return &corearchive.ArchiveError{
+				Archive: archive.Name(),
+				Member:  pattern.text,
+				Offset:  -1,
+				Err:     corearchive.ErrMemberNotFound,
+			}
+		}
+	}
+	return nil
+}
+
+// Returns an iterator over the members that might be selected (in the
+// order they are in the archive). Without any globs, those are only
+// the members with the names of the patterns (or inside of them).
+func (selector *member_selector) candidates(archive *corearchive.Reader) iter.Seq2[corearchive.Header, error] {
+	switch {
+	case len(selector.patterns) == 0 || len(selector.globs) > 0:
+		return archive.All()
+	case len(selector.literals) == 0:
+		return archive.FindAll(slices.Collect(maps.Keys(selector.exact)), false)
+	case len(selector.exact) == 0:
+		names := []string{}
+		for name := range selector.literals {
+			// A literal pattern also matches a name that
+			// starts with "/".
+			names = append(names, name, "/"+name)
+		}
+		return archive.FindAll(names, true)
+	}
+	return archive.All()
+}
+
+// Returns all of the selected members of an archive (for the
+// commands that need all of them at once).
+func (selector *member_selector) select_members(archive *corearchive.Reader) ([]corearchive.Header, error) {
+	selected := []corearchive.Header{}
+	for header, err := range selector.members(archive) {
+		if err != nil {
+			return nil, err
+		}
+		selected = append(selected, header)
+	}
+	return selected, nil
+}
+
+// Call visit with each member (stopping at the first error).
+func each_member(members iter.Seq2[corearchive.Header, error], visit func(header corearchive.Header) error) error {
+	for header, err := range members {
+		if err == nil {
+			err = visit(header)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// An iterator over headers that are already in memory.
+func all_headers(headers []corearchive.Header) iter.Seq2[corearchive.Header, error] {
+	return func(yield func(corearchive.Header, error) bool) {
+		for _, header := range headers {
+			if !yield(header, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/jasonaaronwilson/omni-archive/src/go/corearchive"
+)
+
+// From <linux/stat.h> and <fcntl.h> (the syscall package doesn't
+// export them).
+const (
+	UTIME_OMIT          = (1 << 30) - 2
+	AT_SYMLINK_NOFOLLOW = 0x100
+)
+
+// Create a FIFO or a device node for a member. Like everything else
+// this is done relative to the (safely opened) parent directory.
+func make_special_file(directory output_directory, filename string, header corearchive.Header, permissions fs.FileMode) error {
+	kind := uint32(0)
+	device := uint64(0)
+	switch header.FileType() {
+	case corearchive.FILE_TYPE_FIFO:
+		kind = syscall.S_IFIFO
+	case corearchive.FILE_TYPE_CHARACTER_DEVICE, corearchive.FILE_TYPE_BLOCK_DEVICE:
+		major, minor, err := header.Device()
+		if err != nil {
+			return err
+		}
+		kind = syscall.S_IFBLK
+		if header.FileType() == corearchive.FILE_TYPE_CHARACTER_DEVICE {
+			kind = syscall.S_IFCHR
+		}
+		// The inverse of glibc's major() and minor().
+		device = uint64(major&0xfff)<<8 | uint64(major&^0xfff)<<32 |
+			uint64(minor&0xff) | uint64(minor&^0xff)<<12
+	}
+	parent, err := directory.Open(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	err = syscall.Mknodat(int(parent.Fd()), filepath.Base(filename), kind|uint32(permissions.Perm()), int(device))
+	if err != nil {
+		return &os.PathError{Op: "mknod", Path: filename, Err: err}
+	}
+	return nil
+}
+
+// Set the modification time of a symbolic link itself (Chtimes would
+// follow it).
+func set_symbolic_link_modification_time(directory output_directory, filename string, modification_time time.Time) error {
+	parent, err := directory.Open(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	path, err := syscall.BytePtrFromString(filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	times := [2]syscall.Timespec{
+		{Nsec: UTIME_OMIT},
+		syscall.NsecToTimespec(modification_time.UnixNano()),
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, parent.Fd(),
+		uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&times[0])), AT_SYMLINK_NOFOLLOW, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "utimensat", Path: filename, Err: errno}
+	}
+	return nil
+}
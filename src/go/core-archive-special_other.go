@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/jasonaaronwilson/omni-archive/src/go/corearchive"
+)
+
+// FIFOs and device nodes can only be created on Linux for now (other
+// systems need their own mknod() equivalents).
+func make_special_file(directory output_directory, filename string, header corearchive.Header, permissions fs.FileMode) error {
+	return fmt.Errorf("%w: can't create a %s here", corearchive.ErrUnknownFileType, header.FileType())
+}
+
+// Without lutimes() we leave the modification time of symbolic links
+// alone.
+func set_symbolic_link_modification_time(directory output_directory, filename string, modification_time time.Time) error {
+	return nil
+}
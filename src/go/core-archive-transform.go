@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Member names can be changed on their way into an archive (create)
+// or out of it (extract) the same way GNU tar does it: first
+// --strip-components=N removes leading directories and then each
+// --transform rule is applied in order.
+type name_transformer struct {
+	strip_components int
+	rules            []transform_rule
+}
+
+// A single sed style "s/regexp/replacement/flags" rule. The
+// replacement may use "\1" through "\9" for submatches and "&" for
+// the whole match. The flags are "g" (replace every match instead of
+// just the first one) and "i" (ignore case).
+type transform_rule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	global      bool
+}
+
+// Handle --strip-components and --transform. Several rules may be
+// given separated by ";" (for example "s/^a/b/;s/c$/d/").
+func parse_name_transformer(options map[string]string) (*name_transformer, error) {
+	transformer := &name_transformer{}
+	if value, ok := options["strip-components"]; ok {
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, usage_error("bad --strip-components " + value)
+		}
+		transformer.strip_components = count
+	}
+	if expression, ok := options["transform"]; ok {
+		rules, err := parse_transform_rules(expression)
+		if err != nil {
+			return nil, usage_error(fmt.Sprintf("bad --transform %q: %v", expression, err))
+		}
+		transformer.rules = rules
+	}
+	return transformer, nil
+}
+
+func parse_transform_rules(expression string) ([]transform_rule, error) {
+	rules := []transform_rule{}
+	for expression != "" {
+		if len(expression) < 2 || expression[0] != 's' {
+			return nil, fmt.Errorf("expected s/regexp/replacement/")
+		}
+		delimiter := expression[1]
+		parts := []string{}
+		rest := expression[2:]
+		for len(parts) < 2 {
+			part, remaining, ok := cut_delimited(rest, delimiter)
+			if !ok {
+				return nil, fmt.Errorf("missing %q", delimiter)
+			}
+			parts = append(parts, part)
+			rest = remaining
+		}
+		flags, remaining, _ := strings.Cut(rest, ";")
+		expression = remaining
+
+		rule := transform_rule{replacement: sed_replacement(parts[1])}
+		pattern := parts[0]
+		for _, flag := range flags {
+			switch flag {
+			case 'g':
+				rule.global = true
+			case 'i':
+				pattern = "(?i)" + pattern
+			default:
+				return nil, fmt.Errorf("unknown flag %q", flag)
+			}
+		}
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		rule.pattern = compiled
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Split off everything up to an (unescaped) delimiter. An escaped
+// delimiter stands for itself.
+func cut_delimited(text string, delimiter byte) (string, string, bool) {
+	result := []byte{}
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\\' && i+1 < len(text) && text[i+1] == delimiter:
+			result = append(result, delimiter)
+			i++
+		case text[i] == '\\' && i+1 < len(text):
+			result = append(result, text[i], text[i+1])
+			i++
+		case text[i] == delimiter:
+			return string(result), text[i+1:], true
+		default:
+			result = append(result, text[i])
+		}
+	}
+	return "", "", false
+}
+
+// Convert a sed replacement into the syntax of regexp.Expand.
+func sed_replacement(replacement string) string {
+	result := strings.Builder{}
+	for i := 0; i < len(replacement); i++ {
+		character := replacement[i]
+		switch {
+		case character == '\\' && i+1 < len(replacement):
+			i++
+			next := replacement[i]
+			if next >= '0' && next <= '9' {
+				result.WriteString("${" + string(next) + "}")
+			} else if next == '$' {
+				result.WriteString("$$")
+			} else {
+				result.WriteByte(next)
+			}
+		case character == '&':
+			result.WriteString("${0}")
+		case character == '$':
+			result.WriteString("$$")
+		default:
+			result.WriteByte(character)
+		}
+	}
+	return result.String()
+}
+
+// Transform a member name. Returns false when nothing is left of it
+// (so the member should be skipped).
+func (transformer *name_transformer) transform(name string) (string, bool) {
+	if transformer.strip_components > 0 {
+		parts := strings.Split(strings.Trim(name, "/"), "/")
+		if len(parts) <= transformer.strip_components {
+			return "", false
+		}
+		name = strings.Join(parts[transformer.strip_components:], "/")
+	}
+	for _, rule := range transformer.rules {
+		name = rule.apply(name)
+	}
+	return name, name != ""
+}
+
+func (rule transform_rule) apply(name string) string {
+	count := 1
+	if rule.global {
+		count = -1
+	}
+	result := []byte{}
+	last := 0
+	for _, match := range rule.pattern.FindAllStringSubmatchIndex(name, count) {
+		result = append(result, name[last:match[0]]...)
+		result = rule.pattern.ExpandString(result, rule.replacement, name, match)
+		last = match[1]
+	}
+	return string(append(result, name[last:]...))
+}
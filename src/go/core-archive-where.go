@@ -0,0 +1,512 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jasonaaronwilson/omni-archive/src/go/corearchive"
+)
+
+// A --where expression selects members by the values in their
+// headers, for example:
+//
+//	x-part-type == "icon" && size > 1MiB && file-name ~ "\.png$"
+//
+// Keys are written without their ":". A key alone is true when a
+// member has it. Comparisons (==, !=, <, <=, >, >=) are done with
+// numbers when either side is a number (keys like size: are read as
+// hexidecimal and other values as decimal), with times when either
+// side is mtime (which compares with "2006-01-02" or
+// "2006-01-02T15:04:05Z07:00" strings or seconds since 1970), and
+// with strings otherwise. ~ and !~ match a regular expression. A
+// comparison with a key a member doesn't have is always false.
+// Comparisons can be combined with &&, ||, ! and parentheses.
+type where_expression interface {
+	evaluate(header corearchive.Header) bool
+}
+
+// These keys have hexidecimal numbers as their values.
+var hexidecimal_keys = []string{
+	corearchive.SIZE_KEY,
+	corearchive.START_KEY,
+	corearchive.ALIGN_KEY,
+	corearchive.DATA_SIZE_KEY,
+}
+
+// The modification time of a member (from its
+// posix-modification-time-seconds: and -nanos:).
+const WHERE_MTIME = "mtime"
+
+// Multipliers for numbers like "1MiB" or "10k" (in lower case).
+var where_units = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1e3,
+	"kb":  1e3,
+	"kib": 1 << 10,
+	"m":   1e6,
+	"mb":  1e6,
+	"mib": 1 << 20,
+	"g":   1e9,
+	"gb":  1e9,
+	"gib": 1 << 30,
+	"t":   1e12,
+	"tb":  1e12,
+	"tib": 1 << 40,
+}
+
+var where_time_formats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// Parse a --where expression.
+func parse_where(text string) (where_expression, error) {
+	tokens, err := tokenize_where(text)
+	if err != nil {
+		return nil, err
+	}
+	parser := &where_parser{tokens: tokens}
+	expression, err := parser.parse_or()
+	if err != nil {
+		return nil, err
+	}
+	if parser.position < len(tokens) {
+		return nil, fmt.Errorf("unexpected %q", tokens[parser.position].text)
+	}
+	return expression, nil
+}
+
+const (
+	WHERE_KEY = iota
+	WHERE_STRING
+	WHERE_NUMBER
+	WHERE_OPERATOR
+)
+
+type where_token struct {
+	kind int
+	text string
+}
+
+// Longer operators have to come first.
+var where_operators = []string{
+	"&&", "||", "==", "!=", "<=", ">=", "!~", "(", ")", "!", "<", ">", "~",
+}
+
+func tokenize_where(text string) ([]where_token, error) {
+	tokens := []where_token{}
+	for i := 0; i < len(text); {
+		character := text[i]
+		switch {
+		case character == ' ' || character == '\t' || character == '\n':
+			i++
+		case character == '"' || character == '\'':
+			value, length, err := scan_where_string(text[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, where_token{WHERE_STRING, value})
+			i += length
+		case is_where_word_character(character) || character == '-' && i+1 < len(text) && is_digit(text[i+1]):
+			start := i
+			for i++; i < len(text) && is_where_word_character(text[i]); i++ {
+			}
+			word := text[start:i]
+			if is_digit(word[0]) || word[0] == '-' {
+				tokens = append(tokens, where_token{WHERE_NUMBER, word})
+			} else {
+				tokens = append(tokens, where_token{WHERE_KEY, strings.TrimSuffix(word, ":") + ":"})
+			}
+		default:
+			operator := ""
+			for _, candidate := range where_operators {
+				if strings.HasPrefix(text[i:], candidate) {
+					operator = candidate
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected %q", text[i:i+1])
+			}
+			tokens = append(tokens, where_token{WHERE_OPERATOR, operator})
+			i += len(operator)
+		}
+	}
+	return tokens, nil
+}
+
+func is_digit(character byte) bool {
+	return character >= '0' && character <= '9'
+}
+
+func is_where_word_character(character byte) bool {
+	return is_digit(character) ||
+		character >= 'a' && character <= 'z' ||
+		character >= 'A' && character <= 'Z' ||
+		strings.IndexByte("-_.:", character) >= 0
+}
+
+// Scan a quoted string. Only the quote and backslash can be escaped
+// (so regular expressions like "\.png$" don't need doubled
+// backslashes). Returns the string and how much of text it took.
+func scan_where_string(text string) (string, int, error) {
+	quote := text[0]
+	result := strings.Builder{}
+	for i := 1; i < len(text); i++ {
+		switch {
+		case text[i] == '\\' && i+1 < len(text) && (text[i+1] == quote || text[i+1] == '\\'):
+			i++
+			result.WriteByte(text[i])
+		case text[i] == quote:
+			return result.String(), i + 1, nil
+		default:
+			result.WriteByte(text[i])
+		}
+	}
+	return "", 0, errors.New("missing closing quote")
+}
+
+type where_parser struct {
+	tokens   []where_token
+	position int
+}
+
+// Consume the next token if it is the given operator.
+func (parser *where_parser) accept(operator string) bool {
+	if parser.position < len(parser.tokens) {
+		token := parser.tokens[parser.position]
+		if token.kind == WHERE_OPERATOR && token.text == operator {
+			parser.position++
+			return true
+		}
+	}
+	return false
+}
+
+func (parser *where_parser) parse_or() (where_expression, error) {
+	left, err := parser.parse_and()
+	for err == nil && parser.accept("||") {
+		var right where_expression
+		right, err = parser.parse_and()
+		left = where_or{left, right}
+	}
+	return left, err
+}
+
+func (parser *where_parser) parse_and() (where_expression, error) {
+	left, err := parser.parse_not()
+	for err == nil && parser.accept("&&") {
+		var right where_expression
+		right, err = parser.parse_not()
+		left = where_and{left, right}
+	}
+	return left, err
+}
+
+func (parser *where_parser) parse_not() (where_expression, error) {
+	if parser.accept("!") {
+		expression, err := parser.parse_not()
+		return where_not{expression}, err
+	}
+	return parser.parse_primary()
+}
+
+func (parser *where_parser) parse_primary() (where_expression, error) {
+	if parser.accept("(") {
+		expression, err := parser.parse_or()
+		if err != nil {
+			return nil, err
+		}
+		if !parser.accept(")") {
+			return nil, errors.New("missing )")
+		}
+		return expression, nil
+	}
+	left, err := parser.parse_operand()
+	if err != nil {
+		return nil, err
+	}
+	for _, operator := range []string{"==", "!=", "<=", ">=", "<", ">", "~", "!~"} {
+		if parser.accept(operator) {
+			right, err := parser.parse_operand()
+			if err != nil {
+				return nil, err
+			}
+			return new_where_comparison(left, operator, right)
+		}
+	}
+	if left.kind != WHERE_KEY {
+		return nil, fmt.Errorf("%q needs to be compared with something", left.text)
+	}
+	return where_has{left.text}, nil
+}
+
+func (parser *where_parser) parse_operand() (where_token, error) {
+	if parser.position >= len(parser.tokens) {
+		return where_token{}, errors.New("unexpected end")
+	}
+	token := parser.tokens[parser.position]
+	if token.kind == WHERE_OPERATOR {
+		return where_token{}, fmt.Errorf("unexpected %q", token.text)
+	}
+	parser.position++
+	return token, nil
+}
+
+type where_and struct{ left, right where_expression }
+
+func (expression where_and) evaluate(header corearchive.Header) bool {
+	return expression.left.evaluate(header) && expression.right.evaluate(header)
+}
+
+type where_or struct{ left, right where_expression }
+
+func (expression where_or) evaluate(header corearchive.Header) bool {
+	return expression.left.evaluate(header) || expression.right.evaluate(header)
+}
+
+type where_not struct{ expression where_expression }
+
+func (expression where_not) evaluate(header corearchive.Header) bool {
+	return !expression.expression.evaluate(header)
+}
+
+type where_has struct{ key string }
+
+func (expression where_has) evaluate(header corearchive.Header) bool {
+	_, ok := where_value(header, expression.key)
+	return ok
+}
+
+// How the two sides of a comparison are compared.
+const (
+	WHERE_COMPARE_STRINGS = iota
+	WHERE_COMPARE_NUMBERS
+	WHERE_COMPARE_TIMES
+	WHERE_COMPARE_PATTERN
+)
+
+type where_comparison struct {
+	left, right where_token
+	operator    string
+	compare     int
+	pattern     *regexp.Regexp
+}
+
+// Decide how to compare two operands (and check any literals can be
+// compared that way).
+func new_where_comparison(left where_token, operator string, right where_token) (where_expression, error) {
+	comparison := where_comparison{left: left, right: right, operator: operator}
+	switch {
+	case operator == "~" || operator == "!~":
+		if right.kind == WHERE_KEY {
+			return nil, fmt.Errorf("%s needs a regular expression", operator)
+		}
+		if left.kind == WHERE_KEY && left.text == WHERE_MTIME+":" {
+			return nil, fmt.Errorf("%s can't be used with %s (try < or >)", operator, WHERE_MTIME)
+		}
+		pattern, err := regexp.Compile(right.text)
+		if err != nil {
+			return nil, err
+		}
+		comparison.compare, comparison.pattern = WHERE_COMPARE_PATTERN, pattern
+		return comparison, nil
+	case left.text == WHERE_MTIME+":" || right.text == WHERE_MTIME+":":
+		comparison.compare = WHERE_COMPARE_TIMES
+	case left.kind == WHERE_NUMBER || right.kind == WHERE_NUMBER ||
+		is_hexidecimal_key(left) || is_hexidecimal_key(right):
+		comparison.compare = WHERE_COMPARE_NUMBERS
+	}
+	for _, operand := range []where_token{left, right} {
+		if operand.kind == WHERE_KEY {
+			continue
+		}
+		if _, ok := comparison.operand(nil, operand); !ok {
+			return nil, fmt.Errorf("can't compare %q with %s", operand.text, strings.TrimSuffix(left.text, ":"))
+		}
+	}
+	return comparison, nil
+}
+
+func is_hexidecimal_key(token where_token) bool {
+	if token.kind != WHERE_KEY {
+		return false
+	}
+	for _, key := range hexidecimal_keys {
+		if token.text == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (comparison where_comparison) evaluate(header corearchive.Header) bool {
+	left, ok := comparison.operand(header, comparison.left)
+	if !ok {
+		return false
+	}
+	if comparison.compare == WHERE_COMPARE_PATTERN {
+		return comparison.pattern.MatchString(left.(string)) == (comparison.operator == "~")
+	}
+	right, ok := comparison.operand(header, comparison.right)
+	if !ok {
+		return false
+	}
+	order := 0
+	switch comparison.compare {
+	case WHERE_COMPARE_NUMBERS:
+		order = left.(where_number).compare(right.(where_number))
+	case WHERE_COMPARE_TIMES:
+		order = left.(time.Time).Compare(right.(time.Time))
+	default:
+		order = strings.Compare(left.(string), right.(string))
+	}
+	switch comparison.operator {
+	case "==":
+		return order == 0
+	case "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	}
+	return order >= 0
+}
+
+// Returns the value of an operand as the type being compared (or
+// false when the member doesn't have it or it isn't that type).
+func (comparison where_comparison) operand(header corearchive.Header, token where_token) (any, bool) {
+	if token.kind == WHERE_KEY && token.text == WHERE_MTIME+":" {
+		if !header.Has(corearchive.POSIX_MODIFICATION_TIME_SECONDS_KEY) {
+			return nil, false
+		}
+		modification_time, err := header.ModTime()
+		return modification_time, err == nil
+	}
+	text := token.text
+	if token.kind == WHERE_KEY {
+		value, ok := where_value(header, token.text)
+		if !ok {
+			return nil, false
+		}
+		text = value
+	}
+	switch comparison.compare {
+	case WHERE_COMPARE_NUMBERS:
+		if is_hexidecimal_key(token) {
+			value, err := strconv.ParseInt(text, 16, 64)
+			return where_number{integer: value}, err == nil
+		}
+		return parse_where_number(text)
+	case WHERE_COMPARE_TIMES:
+		if token.kind == WHERE_NUMBER {
+			seconds, ok := parse_where_number(text)
+			return time.Unix(seconds.integer, 0), ok && !seconds.is_real
+		}
+		return parse_where_time(text)
+	}
+	return text, true
+}
+
+// The value of a key including the ones with defaults that can be
+// computed from other keys.
+func where_value(header corearchive.Header, key string) (string, bool) {
+	if value, ok := header[key]; ok {
+		return value, true
+	}
+	switch key {
+	case corearchive.FILE_TYPE_KEY:
+		return header.FileType(), true
+	case corearchive.DATA_SIZE_KEY:
+		if header.Has(corearchive.SIZE_KEY) {
+			size, err := header.DataSize()
+			return strconv.FormatInt(size, 16), err == nil
+		}
+	case WHERE_MTIME + ":":
+		return "", header.Has(corearchive.POSIX_MODIFICATION_TIME_SECONDS_KEY)
+	}
+	return "", false
+}
+
+// Numbers are compared exactly unless one of them isn't an integer.
+type where_number struct {
+	integer int64
+	real    float64
+	is_real bool
+}
+
+func (number where_number) float() float64 {
+	if number.is_real {
+		return number.real
+	}
+	return float64(number.integer)
+}
+
+func (number where_number) compare(other where_number) int {
+	if !number.is_real && !other.is_real {
+		switch {
+		case number.integer < other.integer:
+			return -1
+		case number.integer > other.integer:
+			return 1
+		}
+		return 0
+	}
+	switch {
+	case number.float() < other.float():
+		return -1
+	case number.float() > other.float():
+		return 1
+	}
+	return 0
+}
+
+// Parse a decimal number (which may be followed by a unit like "MiB")
+// or a hexidecimal number starting with "0x".
+func parse_where_number(text string) (where_number, bool) {
+	digits := strings.TrimPrefix(text, "-")
+	if strings.HasPrefix(digits, "0x") || strings.HasPrefix(digits, "0X") {
+		value, err := strconv.ParseInt(digits[2:], 16, 64)
+		if text != digits {
+			value = -value
+		}
+		return where_number{integer: value}, err == nil
+	}
+	if value, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return where_number{integer: value}, true
+	}
+	end := len(text) - len(digits)
+	for end < len(text) && (is_digit(text[end]) || text[end] == '.') {
+		end++
+	}
+	value, err := strconv.ParseFloat(text[:end], 64)
+	unit, ok := where_units[strings.ToLower(text[end:])]
+	if err != nil || !ok {
+		return where_number{}, false
+	}
+	value *= unit
+	if value == math.Trunc(value) && math.Abs(value) < 1<<63 {
+		return where_number{integer: int64(value)}, true
+	}
+	return where_number{real: value, is_real: true}, true
+}
+
+func parse_where_time(text string) (any, bool) {
+	for _, format := range where_time_formats {
+		if parsed, err := time.ParseInLocation(format, text, time.Local); err == nil {
+			return parsed, true
+		}
+	}
+	return nil, false
+}
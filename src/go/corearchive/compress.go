@@ -0,0 +1,169 @@
+package corearchive
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// A data-compression-algorithm: value (or a requested
+	// algorithm) we don't know how to handle.
+	ErrUnknownCompressionAlgorithm = errors.New("unknown data-compression-algorithm")
+
+	// Compressed member data couldn't be decompressed or didn't
+	// decompress to data-size: bytes.
+	ErrCorruptData = errors.New("corrupt compressed data")
+)
+
+type compression_algorithm struct {
+	compressor   func(io.Writer) (io.WriteCloser, error)
+	decompressor func(io.Reader) (io.ReadCloser, error)
+}
+
+// The data-compression-algorithm: values we know how to handle.
+var compression_algorithms = map[string]compression_algorithm{
+	"gzip": {
+		compressor: func(output io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(output, gzip.BestCompression)
+		},
+		decompressor: func(input io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(input)
+		},
+	},
+	"zlib": {
+		compressor: func(output io.Writer) (io.WriteCloser, error) {
+			return zlib.NewWriterLevel(output, zlib.BestCompression)
+		},
+		decompressor: zlib.NewReader,
+	},
+	"flate": {
+		compressor: func(output io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(output, flate.BestCompression)
+		},
+		decompressor: func(input io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(input), nil
+		},
+	},
+}
+
+func find_compression_algorithm(name string) (compression_algorithm, error) {
+	algorithm, ok := compression_algorithms[name]
+	if !ok {
+		return compression_algorithm{}, fmt.Errorf("%w: %q", ErrUnknownCompressionAlgorithm, name)
+	}
+	return algorithm, nil
+}
+
+// The size of a member's data once it is decompressed (which is the
+// same as Size() for members that aren't compressed).
+func (header Header) DataSize() (int64, error) {
+	if !header.Has(DATA_SIZE_KEY) {
+		return header.Size()
+	}
+	return parse_offset(DATA_SIZE_KEY, header[DATA_SIZE_KEY])
+}
+
+// Returns true if the data of this member is stored compressed.
+func (header Header) IsCompressed() bool {
+	return header.Has(DATA_COMPRESSION_ALGORITHM_KEY)
+}
+
+// Wrap the raw (stored) data of a member so that reading returns the
+// original data. Members that aren't compressed are returned as is.
+// Reading returns an error wrapping ErrCorruptData if the data
+// doesn't decompress to exactly data-size: bytes.
+func Decompress(header Header, data io.Reader) (io.ReadCloser, error) {
+	size, err := header.DataSize()
+	if err != nil {
+		return nil, err
+	}
+	if !header.IsCompressed() {
+		return io.NopCloser(data), nil
+	}
+	algorithm, err := find_compression_algorithm(header[DATA_COMPRESSION_ALGORITHM_KEY])
+	if err != nil {
+		return nil, err
+	}
+	decompressor, err := algorithm.decompressor(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptData, err)
+	}
+	return &sized_reader{input: decompressor, remaining: size}, nil
+}
+
+// Makes sure a decompressor produces exactly the expected number of
+// bytes.
+type sized_reader struct {
+	input     io.ReadCloser
+	remaining int64
+}
+
+func (reader *sized_reader) Read(buffer []byte) (int, error) {
+	if int64(len(buffer)) > reader.remaining+1 {
+		buffer = buffer[:reader.remaining+1]
+	}
+	n, err := reader.input.Read(buffer)
+	reader.remaining -= int64(n)
+	if reader.remaining < 0 {
+		return 0, fmt.Errorf("%w: more than data-size: bytes", ErrCorruptData)
+	}
+	if err == io.EOF && reader.remaining > 0 {
+		return n, fmt.Errorf("%w: fewer than data-size: bytes", ErrCorruptData)
+	}
+	if err != nil && err != io.EOF {
+		return n, fmt.Errorf("%w: %w", ErrCorruptData, err)
+	}
+	return n, err
+}
+
+func (reader *sized_reader) Close() error {
+	return reader.input.Close()
+}
+
+// Returns a reader over the original (decompressed) data of a member
+// of this archive.
+func (reader *Reader) Open(header Header) (io.ReadCloser, error) {
+	data, err := reader.Data(header)
+	if err != nil {
+		return nil, err
+	}
+	result, err := Decompress(header, data)
+	if err != nil {
+		return nil, reader.error(header, -1, err)
+	}
+	return result, nil
+}
+
+// Compress some data into output returning the number of bytes
+// written to output and the number of bytes read from input.
+func compress(algorithm string, output io.Writer, input io.Reader) (int64, int64, error) {
+	counter := &counting_writer{output: output}
+	compressor, err := compression_algorithms[algorithm].compressor(counter)
+	if err != nil {
+		return 0, 0, err
+	}
+	read, err := io.Copy(compressor, input)
+	if err != nil {
+		compressor.Close()
+		return 0, 0, err
+	}
+	if err := compressor.Close(); err != nil {
+		return 0, 0, err
+	}
+	return counter.count, read, nil
+}
+
+type counting_writer struct {
+	output io.Writer
+	count  int64
+}
+
+func (writer *counting_writer) Write(bytes []byte) (int, error) {
+	n, err := writer.output.Write(bytes)
+	writer.count += int64(n)
+	return n, err
+}
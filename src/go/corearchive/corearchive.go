@@ -0,0 +1,244 @@
+// Package corearchive reads and writes core archives (aka omni
+// archives), a very simple container format made of variable length
+// textual headers followed by the raw data of each member.
+//
+// An archive starts with a sequence of headers. Each header is a
+// sequence of NUL terminated "key:value" lines ended by an empty
+// line, and the header region itself is ended by an empty header (a
+// single zero byte). The data for each member lives after the header
+// region at the offset given by its "start:" key and is "size:"
+// bytes long (both hexidecimal).
+//
+// The command line tool core-archive-command is a thin layer over
+// this package.
+package corearchive
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// These are the only keys we can explicitly read and write though
+// when appending archives, we preserve all of the key/value pairs
+// even if they are not known.
+const (
+	FILE_NAME_KEY = "file-name:"
+	SIZE_KEY      = "size:"
+	START_KEY     = "start:"
+)
+
+// These are additional "known keys" from the spec
+const (
+	ALIGN_KEY                           = "align:"
+	DATA_COMPRESSION_ALGORITHM_KEY      = "data-compression-algorithm:"
+	DATA_HASH_ALGORITHM_KEY             = "data-hash-algorithm:"
+	DATA_HASH_KEY                       = "data-hash:"
+	DATA_SIZE_KEY                       = "data-size:"
+	EXTERNAL_FILE_NAME_KEY              = "external-file-name:"
+	FILE_TYPE_KEY                       = "file-type:"
+	FILE_VERSION_KEY                    = "file-version:"
+	FOR_FILE_NAME_KEY                   = "for-file-name:"
+	LINK_TARGET_KEY                     = "link-target:"
+	METADATA_NAME_KEY                   = "metadata-name:"
+	MIME_VERSION_KEY                    = "mime-version:"
+	POSIX_DEVICE_MAJOR_KEY              = "posix-device-major:"
+	POSIX_DEVICE_MINOR_KEY              = "posix-device-minor:"
+	POSIX_FILE_MODE_KEY                 = "posix-file-mode:"
+	POSIX_GROUP_NAME_KEY                = "posix-group-name:"
+	POSIX_GROUP_NUMBER_KEY              = "posix-group-number:"
+	POSIX_MODIFICATION_TIME_NANOS_KEY   = "posix-modification-time-nanos:"
+	POSIX_MODIFICATION_TIME_SECONDS_KEY = "posix-modification-time-seconds:"
+	POSIX_OWNER_NAME_KEY                = "posix-owner-name:"
+	POSIX_OWNER_NUMBER_KEY              = "posix-owner-number:"
+)
+
+// Application specific keys are prefixed with "x-".
+const (
+	USER_DEFINED_KEY_PREFIX = "x-"
+)
+
+// Copying member data achieves *massive* speedups by reading and
+// writing in chunks instead of one byte at a time. Since we don't try
+// to reuse the allocated buffer (and for other reasons), for now we
+// are just keeping this at a reasonable size.
+const (
+	BUFFER_SIZE = 8192
+)
+
+// A Header is the set of key/value pairs describing a single
+// member. Keys include their trailing ":" (for example
+// FILE_NAME_KEY) and values are everything after it.
+type Header map[string]string
+
+// Return true if the given key is present in a header (even if it's
+// value is the empty string)
+func (header Header) Has(key string) bool {
+	_, is_present := header[key]
+	return is_present
+}
+
+// The number of bytes of data stored for this member. A missing
+// "size:" key means the member has no data.
+func (header Header) Size() (int64, error) {
+	if !header.Has(SIZE_KEY) {
+		return 0, nil
+	}
+	return parse_offset(SIZE_KEY, header[SIZE_KEY])
+}
+
+// The offset of this member's data from the beginning of the
+// archive. Members without any data may not have a "start:" key at
+// all in which case this returns zero.
+func (header Header) Start() (int64, error) {
+	if !header.Has(START_KEY) {
+		return 0, nil
+	}
+	return parse_offset(START_KEY, header[START_KEY])
+}
+
+// The alignment (in bytes) that the start: of this member must be a
+// multiple of. Members without an align: value have an alignment of
+// one.
+func (header Header) Align() (int64, error) {
+	if !header.Has(ALIGN_KEY) {
+		return 1, nil
+	}
+	align, err := parse_offset(ALIGN_KEY, header[ALIGN_KEY])
+	if err == nil && align == 0 {
+		err = fmt.Errorf("%w: %s must not be zero", ErrBadSize, ALIGN_KEY)
+	}
+	return align, err
+}
+
+// This is a debugging routine that creates a textual version of a
+// header to show a user.
+func (header Header) String() string {
+	result := ""
+	visit_by_sorted_key(header,
+		func(key string, value string) {
+			result += key
+			result += value
+			result += "\n"
+		})
+	return result
+}
+
+// Convert the represetation of a header to the file-system disk byte
+// format.
+//
+// A header always ends with a byte of zero which is an empty string
+// and this routine always emits such an empty line.
+func (header Header) Bytes() []byte {
+	result := []byte{}
+	visit_by_sorted_key(header,
+		func(key string, value string) {
+			result = append(result, key_value_pair_to_bytes(key, value)...)
+		})
+	result = append(result, 0)
+	return result
+}
+
+// Examine a single header and return non-localized errors and
+// warnings.
+func (header Header) Validate() []string {
+	result := []string{}
+
+	if !header.Has(SIZE_KEY) {
+		result = append(result, "ERROR: A header does not have the required key -- size:")
+	}
+
+	if _, err := header.Align(); err != nil {
+		result = append(result, "ERROR: "+err.Error())
+	}
+
+	if _, err := header.FileMode(); err != nil {
+		result = append(result, "ERROR: "+err.Error())
+	}
+
+	if _, err := header.ModTime(); err != nil {
+		result = append(result, "ERROR: "+err.Error())
+	}
+
+	switch header.FileType() {
+	case FILE_TYPE_REGULAR, FILE_TYPE_DIRECTORY, FILE_TYPE_FIFO:
+	case FILE_TYPE_SYMBOLIC_LINK, FILE_TYPE_HARD_LINK:
+		if !header.Has(LINK_TARGET_KEY) {
+			result = append(result, "ERROR: A link does not have the required key -- link-target:")
+		}
+	case FILE_TYPE_CHARACTER_DEVICE, FILE_TYPE_BLOCK_DEVICE:
+		if _, _, err := header.Device(); err != nil {
+			result = append(result, "ERROR: "+err.Error())
+		}
+	default:
+		result = append(result, "WARNING: This tool doesn't understand file-type:"+header.FileType())
+	}
+
+	if header.Has(FILE_VERSION_KEY) {
+		result = append(result, "WARNING: This tool can doesn't handle multiple versions")
+	}
+
+	if header.Has(DATA_COMPRESSION_ALGORITHM_KEY) != header.Has(DATA_SIZE_KEY) {
+		result = append(result, "ERROR: data-compression-algorithm: and data-size: must either both be present or both be absent")
+	}
+
+	if header.Has(DATA_COMPRESSION_ALGORITHM_KEY) {
+		if _, err := find_compression_algorithm(header[DATA_COMPRESSION_ALGORITHM_KEY]); err != nil {
+			result = append(result, "WARNING: This tool can't decompress "+header[DATA_COMPRESSION_ALGORITHM_KEY])
+		}
+	}
+
+	// TODO:(jawilson): validate the layout which obviously can't be done here.
+
+	return result
+}
+
+func key_value_pair_to_bytes(key string, value string) []byte {
+	result := []byte{}
+	result = append(result, []byte(key)...)
+	result = append(result, []byte(value)...)
+	result = append(result, 0)
+	return result
+}
+
+// Convert a possibly zero prefixed hexidecimal number to a
+// non-negative int64 or return an error wrapping ErrBadSize.
+func parse_offset(key string, value string) (int64, error) {
+	num, err := strconv.ParseInt(value, 16, 64)
+	if err != nil || num < 0 {
+		return 0, fmt.Errorf("%w: %s%q", ErrBadSize, key, value)
+	}
+	return num, nil
+}
+
+// Convert a decimal number (which is how the numbers of the posix-*
+// keys are written) to a non-negative int64 or return an error
+// wrapping ErrBadSize.
+func parse_decimal(key string, value string) (int64, error) {
+	num, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || num < 0 {
+		return 0, fmt.Errorf("%w: %s%q", ErrBadSize, key, value)
+	}
+	return num, nil
+}
+
+// Visit the keys value pairs of this map according to the the
+// "natural" sort order of the keys.
+func visit_by_sorted_key(m map[string]string, visitor func(key string, value string)) {
+	keys := sorted_keys(m)
+	for _, key := range keys {
+		visitor(key, m[key])
+	}
+}
+
+// Returns the keys of a map according to a sort function.
+func sorted_keys(m map[string]string) []string {
+	result := []string{}
+	for key := range m {
+		result = append(result, key)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
@@ -0,0 +1,21 @@
+package corearchive
+
+import (
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+// Record the major and minor numbers of a character or block device
+// (using the same encoding as glibc's major() and minor()).
+func set_device(header Header, info fs.FileInfo) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.Mode()&fs.ModeDevice == 0 {
+		return
+	}
+	device := uint64(stat.Rdev)
+	major := (device>>8)&0xfff | (device>>32)&^0xfff
+	minor := device&0xff | (device>>12)&^0xff
+	header[POSIX_DEVICE_MAJOR_KEY] = fmt.Sprintf("%d", major)
+	header[POSIX_DEVICE_MINOR_KEY] = fmt.Sprintf("%d", minor)
+}
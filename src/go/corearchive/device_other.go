@@ -0,0 +1,12 @@
+//go:build !linux
+
+package corearchive
+
+import (
+	"io/fs"
+)
+
+// Device numbers are encoded differently everywhere so for now we
+// only know how to decode them on Linux.
+func set_device(header Header, info fs.FileInfo) {
+}
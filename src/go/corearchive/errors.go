@@ -0,0 +1,76 @@
+package corearchive
+
+import (
+	"errors"
+	"fmt"
+)
+
+// These are the classes of errors this package reports. Except for
+// ErrWriterClosed, they are always wrapped in an *ArchiveError that
+// says where the problem was found so callers should test for them
+// with errors.Is.
+var (
+	// The archive ended in the middle of a header (or before the
+	// empty header that ends the header region).
+	ErrTruncatedHeader = errors.New("truncated header")
+
+	// The archive ended before all of the data of a member.
+	ErrTruncatedData = errors.New("truncated member data")
+
+	// A "size:" or "start:" value is not a non-negative
+	// hexidecimal number or doesn't agree with the data provided
+	// for a member.
+	ErrBadSize = errors.New("bad size")
+
+	// The data of a member overlaps the header region or the data
+	// of another member.
+	ErrLayoutOverlap = errors.New("member data overlaps")
+
+	// No member has the requested file-name.
+	ErrMemberNotFound = errors.New("member not found")
+
+	// Member data was read from a stream (see NewStreamReader)
+	// after the stream had already passed it or would need more
+	// spooling than the Limits allow.
+	ErrNotStreamable = errors.New("member data can't be read from a stream in this order")
+
+	// A Writer (or a member being written) was used after it was
+	// closed.
+	ErrWriterClosed = errors.New("writer is closed")
+)
+
+// An ArchiveError records where in which archive a problem was
+// found.
+type ArchiveError struct {
+	// The name of the archive (possibly empty when the archive
+	// was given to us as an anonymous reader or writer).
+	Archive string
+
+	// The file-name of the member involved, if any.
+	Member string
+
+	// The byte offset within the archive where the problem was
+	// found or -1 when there isn't a meaningful offset.
+	Offset int64
+
+	// The underlying error, usually one of the Err* values above.
+	Err error
+}
+
+func (e *ArchiveError) Error() string {
+	result := ""
+	if e.Archive != "" {
+		result += e.Archive + ": "
+	}
+	if e.Offset >= 0 {
+		result += fmt.Sprintf("offset 0x%x: ", e.Offset)
+	}
+	if e.Member != "" {
+		result += fmt.Sprintf("member %q: ", e.Member)
+	}
+	return result + e.Err.Error()
+}
+
+func (e *ArchiveError) Unwrap() error {
+	return e.Err
+}
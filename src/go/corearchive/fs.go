@@ -0,0 +1,374 @@
+package corearchive
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An FS presents the members of an archive as a read-only file
+// system (so it can be used with http.FS, template.ParseFS,
+// fs.WalkDir, etc.) The directory tree is built from the file-name:
+// values of the members and the contents of a file are read straight
+// from the archive.
+//
+// Members without a file-name: or whose file-name isn't a valid
+// fs.FS path (absolute names, names containing "..", etc.) are not
+// visible. When more than one member has the same file-name, the
+// first one wins (just like Reader.Find).
+type FS struct {
+	reader *Reader
+	root   *fs_node
+}
+
+// Either a directory (children is non-nil) or a file (header is
+// non-nil).
+type fs_node struct {
+	name     string
+	header   Header
+	size     int64
+	children map[string]*fs_node
+}
+
+// Open the named archive as an FS. The returned FS must be closed by
+// the caller.
+func OpenFS(archive_name string) (*FS, error) {
+	reader, err := OpenReader(archive_name)
+	if err != nil {
+		return nil, err
+	}
+	fsys, err := NewFS(reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return fsys, nil
+}
+
+// Create an FS from an already open archive. Closing the FS closes
+// the reader (which isn't closed when there is an error). Only a lazy
+// Reader can fail (when its archive changes after it was opened).
+func NewFS(reader *Reader) (*FS, error) {
+	root := &fs_node{name: ".", children: make(map[string]*fs_node)}
+	// Hard links share the data of an earlier member.
+	by_name := make(map[string]Header)
+	for header, err := range reader.All() {
+		if err != nil {
+			return nil, err
+		}
+		name, ok := header[FILE_NAME_KEY]
+		if !ok || name == "." || !fs.ValidPath(name) {
+			continue
+		}
+		if _, seen := by_name[name]; seen {
+			continue
+		}
+		if header.FileType() == FILE_TYPE_HARD_LINK {
+			target, ok := by_name[header[LINK_TARGET_KEY]]
+			if !ok {
+				continue
+			}
+			header = target
+		}
+		by_name[name] = header
+		// NewReader has already checked the sizes.
+		size, _ := header.DataSize()
+		root.add(name, header, size)
+	}
+	return &FS{reader: reader, root: root}, nil
+}
+
+// Add a member to the tree creating any missing directories. A file
+// never replaces a directory but a directory does replace a file
+// (when a later member is inside of it). Directory members just
+// supply the header of their directory.
+func (root *fs_node) add(name string, header Header, size int64) {
+	parts := strings.Split(name, "/")
+	dir := root
+	for _, part := range parts[:len(parts)-1] {
+		child := dir.children[part]
+		if child == nil || child.children == nil {
+			child = &fs_node{name: part, children: make(map[string]*fs_node)}
+			dir.children[part] = child
+		}
+		dir = child
+	}
+	base := parts[len(parts)-1]
+	existing := dir.children[base]
+	if mode, _ := header.FileMode(); mode.IsDir() {
+		if existing == nil || existing.children == nil {
+			existing = &fs_node{name: base, children: make(map[string]*fs_node)}
+			dir.children[base] = existing
+		}
+		existing.header = header
+		return
+	}
+	if existing != nil && existing.children != nil {
+		return
+	}
+	dir.children[base] = &fs_node{name: base, header: header, size: size}
+}
+
+// Close the underlying archive.
+func (fsys *FS) Close() error {
+	return fsys.reader.Close()
+}
+
+func (fsys *FS) lookup(op string, name string) (*fs_node, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	node := fsys.root
+	if name == "." {
+		return node, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		if node.children == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		node = node.children[part]
+		if node == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return node, nil
+}
+
+// Open implements fs.FS.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	node, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if node.children != nil {
+		return &fs_dir{node: node, entries: node.entries()}, nil
+	}
+	if node.header.IsCompressed() {
+		file := &fs_compressed_file{fsys: fsys, node: node}
+		if err := file.rewind(); err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return file, nil
+	}
+	data, err := fsys.reader.Data(node.header)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &fs_file{node: node, SectionReader: data}, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	node, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if node.children == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return node.entries(), nil
+}
+
+// Stat implements fs.StatFS.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	node, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	node, err := fsys.lookup("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if node.children != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	data, err := fsys.reader.Open(node.header)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	defer data.Close()
+	result := make([]byte, node.size)
+	if _, err := io.ReadFull(data, result); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return result, nil
+}
+
+// The children of a directory sorted by name.
+func (node *fs_node) entries() []fs.DirEntry {
+	result := make([]fs.DirEntry, 0, len(node.children))
+	for _, child := range node.children {
+		result = append(result, child)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result
+}
+
+// fs_node implements both fs.FileInfo and fs.DirEntry.
+
+func (node *fs_node) Name() string {
+	return node.name
+}
+
+func (node *fs_node) Size() int64 {
+	return node.size
+}
+
+// The permissions (and the type of anything that isn't a directory
+// or regular file) come from the posix-file-mode: of the member (if it
+// has one).
+func (node *fs_node) Mode() fs.FileMode {
+	mode := fs.FileMode(0444)
+	if node.header.Has(POSIX_FILE_MODE_KEY) {
+		mode, _ = node.header.FileMode()
+	}
+	if node.children != nil {
+		return fs.ModeDir | mode.Perm() | 0111
+	}
+	return mode &^ fs.ModeDir
+}
+
+func (node *fs_node) ModTime() time.Time {
+	modification_time, _ := node.header.ModTime()
+	return modification_time
+}
+
+func (node *fs_node) IsDir() bool {
+	return node.children != nil
+}
+
+// The header of the member (which is nil for directories that
+// aren't members).
+func (node *fs_node) Sys() any {
+	return node.header
+}
+
+func (node *fs_node) Type() fs.FileMode {
+	return node.Mode().Type()
+}
+
+func (node *fs_node) Info() (fs.FileInfo, error) {
+	return node, nil
+}
+
+// An open file. Reads come straight from the archive.
+type fs_file struct {
+	node *fs_node
+	*io.SectionReader
+}
+
+func (file *fs_file) Stat() (fs.FileInfo, error) {
+	return file.node, nil
+}
+
+func (file *fs_file) Close() error {
+	return nil
+}
+
+// An open compressed file. Seeking backwards means starting to
+// decompress again from the beginning so this is only efficient when
+// reading sequentially.
+type fs_compressed_file struct {
+	fsys     *FS
+	node     *fs_node
+	data     io.ReadCloser
+	position int64
+}
+
+func (file *fs_compressed_file) rewind() error {
+	if file.data != nil {
+		file.data.Close()
+	}
+	data, err := file.fsys.reader.Open(file.node.header)
+	if err != nil {
+		return err
+	}
+	file.data = data
+	file.position = 0
+	return nil
+}
+
+func (file *fs_compressed_file) Stat() (fs.FileInfo, error) {
+	return file.node, nil
+}
+
+func (file *fs_compressed_file) Read(buffer []byte) (int, error) {
+	n, err := file.data.Read(buffer)
+	file.position += int64(n)
+	return n, err
+}
+
+func (file *fs_compressed_file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += file.position
+	case io.SeekEnd:
+		offset += file.node.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: file.node.name, Err: fs.ErrInvalid}
+	}
+	if offset < file.position {
+		if err := file.rewind(); err != nil {
+			return 0, err
+		}
+	}
+	if offset > file.position {
+		skipped, err := io.CopyN(io.Discard, file.data, offset-file.position)
+		file.position += skipped
+		if err != nil && err != io.EOF {
+			return file.position, err
+		}
+	}
+	return file.position, nil
+}
+
+func (file *fs_compressed_file) Close() error {
+	return file.data.Close()
+}
+
+// An open directory.
+type fs_dir struct {
+	node    *fs_node
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (dir *fs_dir) Stat() (fs.FileInfo, error) {
+	return dir.node, nil
+}
+
+func (dir *fs_dir) Read(buffer []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: dir.node.name, Err: errors.New("is a directory")}
+}
+
+func (dir *fs_dir) Close() error {
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (dir *fs_dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	remaining := dir.entries[dir.offset:]
+	if count <= 0 {
+		dir.offset = len(dir.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	dir.offset += count
+	return remaining[:count], nil
+}
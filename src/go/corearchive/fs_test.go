@@ -0,0 +1,110 @@
+package corearchive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// Write an archive with a directory, a small file (which compressing
+// doesn't make smaller so it is stored as is), a big file that gets
+// compressed, a hard link to the big file, and another small file
+// with the same name as the first one.
+func write_fs_test_archive(t *testing.T) []byte {
+	output := &bytes.Buffer{}
+	writer := NewWriter(output)
+	if err := writer.SetCompression("gzip"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.CreateMember(Header{FILE_NAME_KEY: "dir", FILE_TYPE_KEY: FILE_TYPE_DIRECTORY}); err != nil {
+		t.Fatal(err)
+	}
+	small := "hi\n"
+	if err := writer.AddSection(Header{FILE_NAME_KEY: "dir/small.txt", SIZE_KEY: "3"}, io.NewSectionReader(strings.NewReader(small), 0, 3)); err != nil {
+		t.Fatal(err)
+	}
+	big, err := writer.CreateMember(Header{FILE_NAME_KEY: "big.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(big, strings.Repeat("the same line over and over\n", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.CreateMember(Header{
+		FILE_NAME_KEY:   "dir/link.txt",
+		FILE_TYPE_KEY:   FILE_TYPE_HARD_LINK,
+		LINK_TARGET_KEY: "big.txt",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first member with a name is visible.
+	if err := writer.AddSection(Header{FILE_NAME_KEY: "dir/small.txt", SIZE_KEY: "3"}, io.NewSectionReader(strings.NewReader("bye"), 0, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return output.Bytes()
+}
+
+func TestFS(t *testing.T) {
+	archive := write_fs_test_archive(t)
+	for _, new_reader := range []struct {
+		name string
+		new  func(string, io.ReaderAt, int64) (*Reader, error)
+	}{{"NewReader", NewReader}, {"NewLazyReader", NewLazyReader}} {
+		t.Run(new_reader.name, func(t *testing.T) {
+			reader, err := new_reader.new("fs-test", bytes.NewReader(archive), int64(len(archive)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			big, err := reader.Find("big.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			small, err := reader.Find("dir/small.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !big.IsCompressed() || small.IsCompressed() {
+				t.Fatalf("only big.txt should be compressed: %v %v", big, small)
+			}
+
+			fsys, err := NewFS(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fsys.Close()
+			if err := fstest.TestFS(fsys, "big.txt", "dir", "dir/small.txt", "dir/link.txt"); err != nil {
+				t.Fatal(err)
+			}
+			linked, err := fsys.ReadFile("dir/link.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(linked) != strings.Repeat("the same line over and over\n", 1000) {
+				t.Fatalf("dir/link.txt has %d bytes of the wrong data", len(linked))
+			}
+			if small, err := fsys.ReadFile("dir/small.txt"); err != nil || string(small) != "hi\n" {
+				t.Fatalf("dir/small.txt isn't the first one: %q %v", small, err)
+			}
+		})
+	}
+}
+
+// The headers of a lazy Reader are parsed again by NewFS which fails
+// when they have changed (instead of leaving members out).
+func TestFSChangedArchive(t *testing.T) {
+	archive := write_fs_test_archive(t)
+	reader, err := NewLazyReader("fs-test", bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive[0] = 0xff
+	if _, err := NewFS(reader); !errors.Is(err, ErrMalformedHeader) {
+		t.Fatalf("NewFS of a changed archive: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package corearchive
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+var (
+	// A member's data doesn't match its data-hash: value.
+	ErrHashMismatch = errors.New("data-hash mismatch")
+
+	// A data-hash-algorithm: value (or a requested algorithm) we
+	// don't know how to compute.
+	ErrUnknownHashAlgorithm = errors.New("unknown data-hash-algorithm")
+)
+
+// The data-hash-algorithm: values we know how to compute. These are
+// the names written into headers.
+var hash_algorithms = map[string]func() hash.Hash{
+	"SHA-1":   sha1.New,
+	"SHA-256": sha256.New,
+	"SHA-512": sha512.New,
+}
+
+// Returns the name we write into headers for a hash algorithm. Names
+// are matched ignoring case and dashes so "sha256" and "SHA-256" are
+// the same algorithm.
+func CanonicalHashAlgorithm(name string) (string, error) {
+	simplified := strings.ToUpper(strings.ReplaceAll(name, "-", ""))
+	for canonical := range hash_algorithms {
+		if strings.ReplaceAll(canonical, "-", "") == simplified {
+			return canonical, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownHashAlgorithm, name)
+}
+
+func new_hash(name string) (hash.Hash, error) {
+	canonical, err := CanonicalHashAlgorithm(name)
+	if err != nil {
+		return nil, err
+	}
+	return hash_algorithms[canonical](), nil
+}
+
+// Compute the hash of some member data and record it in the header
+// as data-hash-algorithm: and data-hash:.
+func HashMember(header Header, algorithm string, data io.Reader) error {
+	digest, err := new_hash(algorithm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(digest, data); err != nil {
+		return err
+	}
+	set_hash(header, algorithm, digest)
+	return nil
+}
+
+func set_hash(header Header, algorithm string, digest hash.Hash) {
+	canonical, _ := CanonicalHashAlgorithm(algorithm)
+	header[DATA_HASH_ALGORITHM_KEY] = canonical
+	header[DATA_HASH_KEY] = hex.EncodeToString(digest.Sum(nil))
+}
+
+// A Verifier checks that the data written to it matches the
+// data-hash: of a member.
+type Verifier struct {
+	header   Header
+	digest   hash.Hash
+	expected string
+}
+
+// Create a Verifier for a member. A member without a data-hash:
+// returns a nil Verifier (and no error). Calling Write and Verify on
+// a nil Verifier is allowed and always succeeds.
+func NewVerifier(header Header) (*Verifier, error) {
+	if !header.Has(DATA_HASH_KEY) {
+		return nil, nil
+	}
+	digest, err := new_hash(header[DATA_HASH_ALGORITHM_KEY])
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{
+		header:   header,
+		digest:   digest,
+		expected: strings.ToLower(header[DATA_HASH_KEY]),
+	}, nil
+}
+
+func (verifier *Verifier) Write(bytes []byte) (int, error) {
+	if verifier == nil {
+		return len(bytes), nil
+	}
+	return verifier.digest.Write(bytes)
+}
+
+// Returns an error wrapping ErrHashMismatch if the data written so
+// far doesn't match the member's data-hash:.
+func (verifier *Verifier) Verify() error {
+	if verifier == nil {
+		return nil
+	}
+	actual := hex.EncodeToString(verifier.digest.Sum(nil))
+	if actual != verifier.expected {
+		return fmt.Errorf("%w: expected %s but got %s", ErrHashMismatch, verifier.expected, actual)
+	}
+	return nil
+}
+
+// Re-hash the data of a member and compare it with the member's
+// data-hash:. Members without a data-hash: always verify.
+func (reader *Reader) Verify(header Header) error {
+	verifier, err := NewVerifier(header)
+	if err != nil {
+		return reader.error(header, -1, err)
+	}
+	if verifier == nil {
+		return nil
+	}
+	data, err := reader.Data(header)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(verifier, data); err != nil {
+		return reader.error(header, -1, err)
+	}
+	if err := verifier.Verify(); err != nil {
+		start, _ := header.Start()
+		return reader.error(header, start, err)
+	}
+	return nil
+}
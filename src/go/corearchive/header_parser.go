@@ -0,0 +1,222 @@
+package corearchive
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Limits on what a HeaderParser (or Reader) will accept so that a
+// hostile or corrupt archive can't make us use an unbounded amount of
+// memory. A zero (or negative) value means there is no limit.
+type Limits struct {
+	// The longest "key:value" line in bytes (not counting the
+	// terminating NUL).
+	MaxLineLength int
+
+	// The most headers (i.e., members) in an archive.
+	MaxHeaders int
+
+	// The most "key:value" lines in a single header.
+	MaxKeysPerHeader int
+
+	// The most member data a Reader created by NewStreamReader
+	// holds in memory at once (for members whose data it has to
+	// read out of order).
+	MaxSpoolSize int64
+}
+
+// The limits used unless some others are explicitly requested. These
+// are far larger than anything a sane archive needs.
+var DefaultLimits = Limits{
+	MaxLineLength:    1 << 20,
+	MaxHeaders:       1 << 26,
+	MaxKeysPerHeader: 1 << 12,
+	MaxSpoolSize:     1 << 28,
+}
+
+// These are the different ways a header can be malformed. They are
+// always reported wrapped together with ErrMalformedHeader so that
+// callers can test for either the general or the specific error.
+var (
+	ErrMalformedHeader = errors.New("malformed header")
+	ErrLineTooLong     = errors.New("header line is too long")
+	ErrTooManyHeaders  = errors.New("too many headers")
+	ErrTooManyKeys     = errors.New("too many keys in a header")
+	ErrInvalidUTF8     = errors.New("header line is not valid UTF-8")
+	ErrMissingKey      = errors.New("header line has no \"key:\" prefix")
+	ErrDuplicateKey    = errors.New("duplicate key in header")
+)
+
+// A HeaderParser reads headers from the start of an archive. It
+// reads its input in large chunks so it will usually consume input
+// beyond the end of the header region (unless the input is already
+// a *bufio.Reader in which case that is used directly).
+type HeaderParser struct {
+	limits  Limits
+	name    string
+	input   *bufio.Reader
+	offset  int64
+	headers int
+	line    []byte
+}
+
+// Create a parser for the headers of an archive. The name is only
+// used to describe the archive in errors.
+func NewHeaderParser(archive_name string, input io.Reader, limits Limits) *HeaderParser {
+	buffered, ok := input.(*bufio.Reader)
+	if !ok {
+		buffered = bufio.NewReaderSize(input, 64*1024)
+	}
+	return &HeaderParser{
+		limits: limits,
+		name:   archive_name,
+		input:  buffered,
+	}
+}
+
+// The offset in the archive just past the last byte parsed. After
+// all headers are read, this is the size of the header region.
+func (parser *HeaderParser) Offset() int64 {
+	return parser.offset
+}
+
+// Read all of the headers up to and including the empty header that
+// ends the header region. A completely empty input is a legal (empty)
+// archive.
+func (parser *HeaderParser) ReadHeaders() ([]Header, error) {
+	headers, _, err := parser.read_headers()
+	return headers, err
+}
+
+// Returns the headers and the offset of each one.
+func (parser *HeaderParser) read_headers() ([]Header, []int64, error) {
+	result := []Header{}
+	offsets := []int64{}
+	err := parser.each_header(func(header Header, offset int64) error {
+		result = append(result, header)
+		offsets = append(offsets, offset)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, offsets, nil
+}
+
+// Call visit with each header (and its offset) up to the empty
+// header that ends the header region (stopping at the first error
+// visit returns).
+func (parser *HeaderParser) each_header(visit func(header Header, offset int64) error) error {
+	for {
+		offset := parser.offset
+		header, err := parser.ReadHeader()
+		if err != nil {
+			// A completely empty archive is legal.
+			if parser.offset == 0 && len(parser.line) == 0 && errors.Is(err, ErrTruncatedHeader) {
+				return nil
+			}
+			return err
+		}
+		if len(header) == 0 {
+			return nil
+		}
+		if err := visit(header, offset); err != nil {
+			return err
+		}
+	}
+}
+
+// Read a sequence of NUL terminated strings until we encounter an
+// empty string. Convert all non-empty strings into a Header where
+// keys are all unicode characters preceding and including the first
+// ":" and values are the rest of the string. Every line must be legal
+// UTF-8, must have a non-empty key, and a key may only appear once in
+// a header. The empty header (which ends the header region) is
+// returned as a Header with no keys.
+func (parser *HeaderParser) ReadHeader() (Header, error) {
+	result := make(Header)
+	for {
+		line_offset := parser.offset
+		line, err := parser.read_line()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		if parser.limits.MaxKeysPerHeader > 0 && len(result) >= parser.limits.MaxKeysPerHeader {
+			return nil, parser.malformed(line_offset, ErrTooManyKeys, "")
+		}
+		if !utf8.Valid(line) {
+			return nil, parser.malformed(line_offset, ErrInvalidUTF8, "")
+		}
+		key_end := bytes.IndexByte(line, ':') + 1
+		if key_end <= 1 {
+			return nil, parser.malformed(line_offset, ErrMissingKey, string(line))
+		}
+		key := string(line[0:key_end])
+		if result.Has(key) {
+			return nil, parser.malformed(line_offset, ErrDuplicateKey, key)
+		}
+		result[key] = string(line[key_end:])
+	}
+	if len(result) > 0 {
+		parser.headers++
+		if parser.limits.MaxHeaders > 0 && parser.headers > parser.limits.MaxHeaders {
+			return nil, parser.malformed(parser.offset, ErrTooManyHeaders, "")
+		}
+	}
+	return result, nil
+}
+
+// Read a line (without its terminating NUL). The returned slice is
+// only valid until the next call.
+func (parser *HeaderParser) read_line() ([]byte, error) {
+	parser.line = parser.line[:0]
+	for {
+		chunk, err := parser.input.ReadSlice(0)
+		parser.line = append(parser.line, chunk...)
+		if err == nil {
+			line := parser.line[:len(parser.line)-1]
+			if parser.limits.MaxLineLength > 0 && len(line) > parser.limits.MaxLineLength {
+				return nil, parser.malformed(parser.offset, ErrLineTooLong, "")
+			}
+			parser.offset += int64(len(parser.line))
+			return line, nil
+		}
+		if parser.limits.MaxLineLength > 0 && len(parser.line) > parser.limits.MaxLineLength {
+			return nil, parser.malformed(parser.offset, ErrLineTooLong, "")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			err = ErrTruncatedHeader
+		}
+		return nil, &ArchiveError{
+			Archive: parser.name,
+			Offset:  parser.offset + int64(len(parser.line)),
+			Err:     err,
+		}
+	}
+}
+
+func (parser *HeaderParser) malformed(offset int64, err error, detail string) error {
+	if len(detail) > 64 {
+		detail = detail[:64] + "..."
+	}
+	if detail != "" {
+		err = fmt.Errorf("%w: %w: %q", ErrMalformedHeader, err, detail)
+	} else {
+		err = fmt.Errorf("%w: %w", ErrMalformedHeader, err)
+	}
+	return &ArchiveError{
+		Archive: parser.name,
+		Offset:  offset,
+		Err:     err,
+	}
+}
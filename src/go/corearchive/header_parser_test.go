@@ -0,0 +1,106 @@
+package corearchive
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Some well formed and some malformed inputs to start fuzzing from.
+func add_header_seeds(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0})
+	f.Add([]byte("file-name:hello.txt\x00size:5\x00start:0000001e\x00\x00\x00HELLO"))
+	f.Add([]byte("x-OR:magic\x00\x00file-name:a\x00size:0\x00\x00\x00"))
+	f.Add([]byte("size:1\x00size:2\x00\x00\x00"))
+	f.Add([]byte("no-colon\x00\x00\x00"))
+	f.Add([]byte(":empty-key\x00\x00\x00"))
+	f.Add([]byte("bad-utf8:\xff\xfe\x00\x00\x00"))
+	f.Add([]byte("file-name:truncated"))
+}
+
+// Parsing arbitrary bytes must never panic and anything we accept
+// must survive being written back out and parsed again.
+func FuzzReadHeader(f *testing.F) {
+	add_header_seeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		limits := Limits{MaxLineLength: 256, MaxHeaders: 16, MaxKeysPerHeader: 16}
+		header, err := NewHeaderParser("fuzz", bytes.NewReader(data), limits).ReadHeader()
+		if err != nil {
+			return
+		}
+		if len(header) > limits.MaxKeysPerHeader {
+			t.Fatalf("header has %d keys", len(header))
+		}
+		again, err := NewHeaderParser("fuzz", bytes.NewReader(header.Bytes()), limits).ReadHeader()
+		if err != nil {
+			t.Fatalf("re-reading %q: %v", header.Bytes(), err)
+		}
+		if !reflect.DeepEqual(header, again) {
+			t.Fatalf("%v != %v", header, again)
+		}
+	})
+}
+
+func FuzzReadHeaders(f *testing.F) {
+	add_header_seeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		limits := Limits{MaxLineLength: 256, MaxHeaders: 16, MaxKeysPerHeader: 16}
+		parser := NewHeaderParser("fuzz", bytes.NewReader(data), limits)
+		headers, err := parser.ReadHeaders()
+		if err != nil {
+			return
+		}
+		if parser.Offset() > int64(len(data)) {
+			t.Fatalf("offset %d is past the end of %d bytes", parser.Offset(), len(data))
+		}
+		if len(headers) > limits.MaxHeaders {
+			t.Fatalf("read %d headers", len(headers))
+		}
+		region := []byte{}
+		for _, header := range headers {
+			region = append(region, header.Bytes()...)
+		}
+		if len(data) > 0 {
+			region = append(region, 0)
+		}
+		// Key order may differ but the size never does.
+		if int64(len(region)) != parser.Offset() {
+			t.Fatalf("header region is %d bytes but re-encodes as %d", parser.Offset(), len(region))
+		}
+		again, err := ReadHeaders(bytes.NewReader(region))
+		if err != nil {
+			t.Fatalf("re-reading: %v", err)
+		}
+		if !reflect.DeepEqual(headers, again) {
+			t.Fatalf("%v != %v", headers, again)
+		}
+	})
+}
+
+// A lazy Reader must accept every archive a Reader accepts and go
+// through exactly the same headers.
+func FuzzLazyReader(f *testing.F) {
+	add_header_seeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		limits := Limits{MaxLineLength: 256, MaxHeaders: 16, MaxKeysPerHeader: 16}
+		reader, err := NewReaderWithLimits("fuzz", bytes.NewReader(data), int64(len(data)), limits)
+		if err != nil {
+			return
+		}
+		lazy, err := NewLazyReaderWithLimits("fuzz", bytes.NewReader(data), int64(len(data)), limits)
+		if err != nil {
+			t.Fatalf("lazy: %v", err)
+		}
+		headers := []Header{}
+		for header, err := range lazy.All() {
+			if err != nil {
+				t.Fatalf("lazy: %v", err)
+			}
+			headers = append(headers, header)
+		}
+		if !reflect.DeepEqual(reader.Headers, headers) {
+			t.Fatalf("%v != %v", reader.Headers, headers)
+		}
+	})
+}
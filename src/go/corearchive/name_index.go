@@ -0,0 +1,126 @@
+package corearchive
+
+import (
+	"io"
+	"iter"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Returns every member named one of filenames (or, when directories
+// is true, whose name starts with one of them followed by a "/") in
+// the order they are in the archive. Each member is only returned
+// once.
+//
+// The first call (or the first call to Find for a lazy Reader) sorts
+// the offsets of the headers by name (which means holding every name
+// in memory while they are sorted) so later calls only parse the
+// headers a binary search looks at and the ones that are returned.
+func (reader *Reader) FindAll(filenames []string, directories bool) iter.Seq2[Header, error] {
+	return func(yield func(Header, error) bool) {
+		offsets := []int64{}
+		for _, filename := range filenames {
+			found, err := reader.find_offsets(filename, directories)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			offsets = append(offsets, found...)
+		}
+		slices.Sort(offsets)
+		for _, offset := range slices.Compact(offsets) {
+			header, err := reader.read_header_at(offset)
+			if !yield(header, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// The header offsets of the members named filename (and those inside
+// of it when directories is true) sorted by name and then offset.
+func (reader *Reader) find_offsets(filename string, directories bool) ([]int64, error) {
+	reader.name_order_built.Do(reader.sort_names)
+	if reader.name_order_err != nil {
+		return nil, reader.name_order_err
+	}
+	offsets := []int64{}
+	// The members inside of a directory sort right after it (and
+	// anything that only starts with its name) since they all start
+	// with the same "name/".
+	prefixes := []string{filename}
+	if directories {
+		prefixes = append(prefixes, filename+"/")
+	}
+	for i, prefix := range prefixes {
+		start, err := reader.search_names(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, offset := range reader.name_order[start:] {
+			header, err := reader.read_header_at(offset)
+			if err != nil {
+				return nil, err
+			}
+			in_range := header[FILE_NAME_KEY] == filename
+			if i > 0 {
+				in_range = strings.HasPrefix(header[FILE_NAME_KEY], prefix)
+			}
+			if !in_range {
+				break
+			}
+			offsets = append(offsets, offset)
+		}
+	}
+	return offsets, nil
+}
+
+// The position in name_order of the first member whose name doesn't
+// sort before filename.
+func (reader *Reader) search_names(filename string) (int, error) {
+	var err error
+	i := sort.Search(len(reader.name_order), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var header Header
+		header, err = reader.read_header_at(reader.name_order[i])
+		return err != nil || header[FILE_NAME_KEY] >= filename
+	})
+	return i, err
+}
+
+// Build name_order from the headers (which are parsed again for a
+// lazy Reader).
+func (reader *Reader) sort_names() {
+	type named struct {
+		name   string
+		offset int64
+	}
+	members := []named{}
+	add := func(header Header, offset int64) error {
+		if name, ok := header[FILE_NAME_KEY]; ok {
+			members = append(members, named{name, offset})
+		}
+		return nil
+	}
+	if reader.lazy {
+		region := io.NewSectionReader(reader.archive, 0, reader.header_region_size)
+		if reader.header_region_size > 0 {
+			reader.name_order_err = NewHeaderParser(reader.name, region, reader.limits).each_header(add)
+		}
+	} else {
+		for i, header := range reader.Headers {
+			add(header, reader.header_offsets[i])
+		}
+	}
+	// Stable so members with the same name stay in archive order.
+	slices.SortStableFunc(members, func(a, b named) int {
+		return strings.Compare(a.name, b.name)
+	})
+	reader.name_order = make([]int64, len(members))
+	for i, member := range members {
+		reader.name_order[i] = member.offset
+	}
+}
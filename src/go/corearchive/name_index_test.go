@@ -0,0 +1,62 @@
+package corearchive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// Find and FindAll have to agree for lazy Readers (which only keep
+// the offsets of the headers sorted by name) and Readers that hold
+// every header.
+func TestFindAll(t *testing.T) {
+	archive := write_fs_test_archive(t)
+	for _, lazy := range []bool{false, true} {
+		new_reader := NewReader
+		if lazy {
+			new_reader = NewLazyReader
+		}
+		reader, err := new_reader("find-test", bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, find := range []struct {
+			names       []string
+			directories bool
+			expected    []string
+		}{
+			{[]string{"dir/small.txt"}, false, []string{"dir/small.txt", "dir/small.txt"}},
+			{[]string{"dir/link.txt", "big.txt"}, false, []string{"big.txt", "dir/link.txt"}},
+			{[]string{"dir"}, false, []string{"dir"}},
+			{[]string{"dir", "dir/link.txt"}, true, []string{"dir", "dir/small.txt", "dir/link.txt", "dir/small.txt"}},
+			{[]string{"di", "big"}, true, []string{}},
+		} {
+			found := []string{}
+			for header, err := range reader.FindAll(find.names, find.directories) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				found = append(found, header[FILE_NAME_KEY])
+			}
+			if !reflect.DeepEqual(found, find.expected) {
+				t.Errorf("lazy=%v FindAll(%q, %v) found %q", lazy, find.names, find.directories, found)
+			}
+		}
+		header, err := reader.Find("dir/small.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := reader.Data(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contents, err := io.ReadAll(data); err != nil || string(contents) != "hi\n" {
+			t.Errorf("lazy=%v Find found %q (%v)", lazy, contents, err)
+		}
+		if _, err := reader.Find("nope"); !errors.Is(err, ErrMemberNotFound) {
+			t.Errorf("lazy=%v Find of a missing member: %v", lazy, err)
+		}
+	}
+}
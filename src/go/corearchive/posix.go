@@ -0,0 +1,244 @@
+package corearchive
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"time"
+)
+
+// A file-type: value we don't know how to handle (or can't handle on
+// this platform).
+var ErrUnknownFileType = errors.New("unknown file-type")
+
+// The file-type: values. Members without a file-type: are regular
+// files (unless their posix-file-mode: says otherwise).
+const (
+	FILE_TYPE_REGULAR          = "regular"
+	FILE_TYPE_DIRECTORY        = "directory"
+	FILE_TYPE_SYMBOLIC_LINK    = "symbolic-link"
+	FILE_TYPE_HARD_LINK        = "hard-link"
+	FILE_TYPE_FIFO             = "fifo"
+	FILE_TYPE_CHARACTER_DEVICE = "character-device"
+	FILE_TYPE_BLOCK_DEVICE     = "block-device"
+)
+
+// Each type of file along with the first character of a
+// posix-file-mode: value (just like "ls -l") and the file-type: value
+// for it (sockets can't be members).
+var file_types = []struct {
+	character byte
+	mode      fs.FileMode
+	name      string
+}{
+	{'d', fs.ModeDir, FILE_TYPE_DIRECTORY},
+	{'l', fs.ModeSymlink, FILE_TYPE_SYMBOLIC_LINK},
+	{'p', fs.ModeNamedPipe, FILE_TYPE_FIFO},
+	{'s', fs.ModeSocket, ""},
+	{'c', fs.ModeDevice | fs.ModeCharDevice, FILE_TYPE_CHARACTER_DEVICE},
+	{'b', fs.ModeDevice, FILE_TYPE_BLOCK_DEVICE},
+	{'-', 0, FILE_TYPE_REGULAR},
+}
+
+// The permission bits in the order "ls -l" shows them.
+const permission_characters = "rwxrwxrwx"
+
+// The setuid, setgid, and sticky bits replace the execute bit of the
+// owner, group, and other permissions (with an upper case letter when
+// the execute bit isn't set).
+var special_characters = map[int]struct {
+	character byte
+	mode      fs.FileMode
+}{
+	2: {'s', fs.ModeSetuid},
+	5: {'s', fs.ModeSetgid},
+	8: {'t', fs.ModeSticky},
+}
+
+// Format a file mode the way "ls -l" does (for example "-rw-r--r--"
+// or "drwxr-sr-x") which is how posix-file-mode: values are written.
+func FormatFileMode(mode fs.FileMode) string {
+	result := []byte("?---------")
+	for _, file_type := range file_types {
+		if mode&(fs.ModeType|fs.ModeCharDevice) == file_type.mode {
+			result[0] = file_type.character
+			break
+		}
+	}
+	for i := 0; i < 9; i++ {
+		executable := mode&(1<<(8-i)) != 0
+		if executable {
+			result[i+1] = permission_characters[i]
+		}
+		if special, ok := special_characters[i]; ok && mode&special.mode != 0 {
+			if executable {
+				result[i+1] = special.character
+			} else {
+				result[i+1] = special.character - 'a' + 'A'
+			}
+		}
+	}
+	return string(result)
+}
+
+// The inverse of FormatFileMode.
+func ParseFileMode(value string) (fs.FileMode, error) {
+	malformed := fmt.Errorf("%w: %s%q", ErrMalformedHeader, POSIX_FILE_MODE_KEY, value)
+	if len(value) != 10 {
+		return 0, malformed
+	}
+	mode := fs.FileMode(0)
+	found := false
+	for _, file_type := range file_types {
+		if value[0] == file_type.character {
+			mode = file_type.mode
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0, malformed
+	}
+	for i := 0; i < 9; i++ {
+		character := value[i+1]
+		special, has_special := special_characters[i]
+		switch {
+		case character == '-':
+		case character == permission_characters[i]:
+			mode |= 1 << (8 - i)
+		case has_special && character == special.character:
+			mode |= 1<<(8-i) | special.mode
+		case has_special && character == special.character-'a'+'A':
+			mode |= special.mode
+		default:
+			return 0, malformed
+		}
+	}
+	return mode, nil
+}
+
+// The type bits of a mode (as in fs.FileMode) for a file-type: value
+// (hard links are regular files). Returns false for values we don't
+// know.
+func FileTypeMode(file_type string) (fs.FileMode, bool) {
+	if file_type == FILE_TYPE_HARD_LINK {
+		return 0, true
+	}
+	for _, candidate := range file_types {
+		if candidate.name != "" && candidate.name == file_type {
+			return candidate.mode, true
+		}
+	}
+	return 0, false
+}
+
+// The file-type: of a member. Members without one get their type from
+// their posix-file-mode: (so directories written before file-type:
+// existed are still directories) and are otherwise regular files.
+func (header Header) FileType() string {
+	if header.Has(FILE_TYPE_KEY) {
+		return header[FILE_TYPE_KEY]
+	}
+	mode, _ := header.FileMode()
+	for _, file_type := range file_types {
+		if mode&(fs.ModeType|fs.ModeCharDevice) == file_type.mode && file_type.name != "" {
+			return file_type.name
+		}
+	}
+	return FILE_TYPE_REGULAR
+}
+
+// The posix-device-major: and posix-device-minor: of a character or
+// block device.
+func (header Header) Device() (int64, int64, error) {
+	major, err := parse_decimal(POSIX_DEVICE_MAJOR_KEY, header[POSIX_DEVICE_MAJOR_KEY])
+	if err != nil {
+		return 0, 0, err
+	}
+	minor, err := parse_decimal(POSIX_DEVICE_MINOR_KEY, header[POSIX_DEVICE_MINOR_KEY])
+	if err != nil {
+		return 0, 0, err
+	}
+	return major, minor, nil
+}
+
+// The posix-file-mode: of a member or zero if it doesn't have one.
+func (header Header) FileMode() (fs.FileMode, error) {
+	if !header.Has(POSIX_FILE_MODE_KEY) {
+		return 0, nil
+	}
+	return ParseFileMode(header[POSIX_FILE_MODE_KEY])
+}
+
+// The modification time of a member from its
+// posix-modification-time-seconds: and
+// posix-modification-time-nanos: or the zero time if it doesn't have
+// one.
+func (header Header) ModTime() (time.Time, error) {
+	if !header.Has(POSIX_MODIFICATION_TIME_SECONDS_KEY) {
+		return time.Time{}, nil
+	}
+	// Unlike sizes, times before 1970 are negative.
+	value := header[POSIX_MODIFICATION_TIME_SECONDS_KEY]
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s%q", ErrBadSize, POSIX_MODIFICATION_TIME_SECONDS_KEY, value)
+	}
+	nanos := int64(0)
+	if header.Has(POSIX_MODIFICATION_TIME_NANOS_KEY) {
+		nanos, err = parse_decimal(POSIX_MODIFICATION_TIME_NANOS_KEY, header[POSIX_MODIFICATION_TIME_NANOS_KEY])
+		if err != nil {
+			return time.Time{}, err
+		}
+		if nanos >= int64(time.Second) {
+			return time.Time{}, fmt.Errorf("%w: %s%q", ErrBadSize, POSIX_MODIFICATION_TIME_NANOS_KEY, header[POSIX_MODIFICATION_TIME_NANOS_KEY])
+		}
+	}
+	return time.Unix(seconds, nanos), nil
+}
+
+// The posix-owner-number: and posix-group-number: of a member. Either
+// is -1 when the member doesn't have it (which is what os.Lchown
+// takes to mean "leave it alone").
+func (header Header) Owner() (int, int, error) {
+	ids := []int{-1, -1}
+	for i, key := range []string{POSIX_OWNER_NUMBER_KEY, POSIX_GROUP_NUMBER_KEY} {
+		if header.Has(key) {
+			id, err := parse_decimal(key, header[key])
+			if err != nil {
+				return -1, -1, err
+			}
+			ids[i] = int(id)
+		}
+	}
+	return ids[0], ids[1], nil
+}
+
+// Create a header for a file on disk with its file-name:, size:,
+// file-type:, and all of the posix-* keys we can find out about (the
+// owner, group, and device numbers are only known on unix like
+// systems). The link is the target of a symbolic link (and is
+// otherwise ignored). Only regular files have any data.
+func FileInfoHeader(info fs.FileInfo, name string, link string) Header {
+	header := make(Header)
+	header[FILE_NAME_KEY] = name
+	size := int64(0)
+	if info.Mode().IsRegular() {
+		size = info.Size()
+	}
+	header[SIZE_KEY] = fmt.Sprintf("%x", size)
+	header[POSIX_FILE_MODE_KEY] = FormatFileMode(info.Mode())
+	if file_type := header.FileType(); file_type != FILE_TYPE_REGULAR {
+		header[FILE_TYPE_KEY] = file_type
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		header[LINK_TARGET_KEY] = link
+	}
+	modification_time := info.ModTime()
+	header[POSIX_MODIFICATION_TIME_SECONDS_KEY] = strconv.FormatInt(modification_time.Unix(), 10)
+	header[POSIX_MODIFICATION_TIME_NANOS_KEY] = strconv.Itoa(modification_time.Nanosecond())
+	set_owner(header, info)
+	set_device(header, info)
+	return header
+}
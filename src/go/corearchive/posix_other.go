@@ -0,0 +1,12 @@
+//go:build !unix
+
+package corearchive
+
+import (
+	"io/fs"
+)
+
+// There is no portable way to find the owner of a file outside of
+// unix like systems.
+func set_owner(header Header, info fs.FileInfo) {
+}
@@ -0,0 +1,54 @@
+//go:build unix
+
+package corearchive
+
+import (
+	"fmt"
+	"io/fs"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// Looking up user and group names can be slow (think LDAP) and
+// archives tend to have lots of files with the same owner.
+var (
+	name_cache_lock sync.Mutex
+	owner_names     = map[uint32]string{}
+	group_names     = map[uint32]string{}
+)
+
+// Record the owner and group numbers (and names when they can be
+// found) of a file.
+func set_owner(header Header, info fs.FileInfo) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	header[POSIX_OWNER_NUMBER_KEY] = fmt.Sprintf("%d", stat.Uid)
+	header[POSIX_GROUP_NUMBER_KEY] = fmt.Sprintf("%d", stat.Gid)
+
+	name_cache_lock.Lock()
+	defer name_cache_lock.Unlock()
+	owner_name, ok := owner_names[stat.Uid]
+	if !ok {
+		if owner, err := user.LookupId(strconv.FormatUint(uint64(stat.Uid), 10)); err == nil {
+			owner_name = owner.Username
+		}
+		owner_names[stat.Uid] = owner_name
+	}
+	group_name, ok := group_names[stat.Gid]
+	if !ok {
+		if group, err := user.LookupGroupId(strconv.FormatUint(uint64(stat.Gid), 10)); err == nil {
+			group_name = group.Name
+		}
+		group_names[stat.Gid] = group_name
+	}
+	if owner_name != "" {
+		header[POSIX_OWNER_NAME_KEY] = owner_name
+	}
+	if group_name != "" {
+		header[POSIX_GROUP_NAME_KEY] = group_name
+	}
+}
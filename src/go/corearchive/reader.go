@@ -0,0 +1,399 @@
+package corearchive
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// A Reader provides random access to the members of an archive. All
+// of the headers are read (and checked) when the Reader is created
+// and member data is read on demand.
+//
+// A lazy Reader (see OpenLazyReader) checks every header when it is
+// created too but doesn't keep them. All parses them again one at a
+// time instead.
+type Reader struct {
+	name    string
+	archive io.ReaderAt
+	closer  io.Closer
+
+	// The offset of each header in the archive (used for errors).
+	header_offsets []int64
+
+	// All of the headers in the archive in the order they appear
+	// (nil for a lazy Reader).
+	Headers []Header
+
+	// How All parses the headers of a lazy Reader.
+	lazy               bool
+	limits             Limits
+	header_region_size int64
+
+	// The index in Headers of the first member with each
+	// file-name: (built the first time Find is called).
+	by_name       map[string]int
+	by_name_built sync.Once
+
+	// The header offsets of every member with a file-name: sorted
+	// by name (see name_index.go).
+	name_order       []int64
+	name_order_err   error
+	name_order_built sync.Once
+}
+
+// Open the named archive and read all of its headers. The returned
+// Reader must be closed by the caller.
+func OpenReader(archive_name string) (*Reader, error) {
+	return OpenReaderWithLimits(archive_name, DefaultLimits)
+}
+
+// Like OpenReader but parses the headers with the given limits rather
+// than DefaultLimits.
+func OpenReaderWithLimits(archive_name string, limits Limits) (*Reader, error) {
+	return open_reader(archive_name, limits, NewReaderWithLimits)
+}
+
+// Like OpenReader but the Reader is lazy (see NewLazyReader).
+func OpenLazyReader(archive_name string) (*Reader, error) {
+	return open_reader(archive_name, DefaultLimits, NewLazyReaderWithLimits)
+}
+
+func open_reader(archive_name string, limits Limits, new_reader func(string, io.ReaderAt, int64, Limits) (*Reader, error)) (*Reader, error) {
+	archive, err := os.Open(archive_name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := archive.Stat()
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	reader, err := new_reader(archive_name, archive, info.Size(), limits)
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	reader.closer = archive
+	return reader, nil
+}
+
+// Create a Reader over an already open archive that is size bytes
+// long (or -1 if the size isn't known). The name is only used to
+// describe the archive in errors.
+func NewReader(archive_name string, archive io.ReaderAt, size int64) (*Reader, error) {
+	return NewReaderWithLimits(archive_name, archive, size, DefaultLimits)
+}
+
+// Like NewReader but parses the headers with the given limits rather
+// than DefaultLimits.
+func NewReaderWithLimits(archive_name string, archive io.ReaderAt, size int64, limits Limits) (*Reader, error) {
+	input := NewHeaderParser(archive_name, io.NewSectionReader(archive, 0, math.MaxInt64), limits)
+	headers, header_offsets, err := input.read_headers()
+	if err != nil {
+		return nil, err
+	}
+	reader := &Reader{
+		name:           archive_name,
+		archive:        archive,
+		header_offsets: header_offsets,
+		Headers:        headers,
+	}
+	if err := reader.check_layout(input.Offset(), size); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Like NewReader except that the headers are only held in memory
+// one at a time (see All) so that archives with millions of members
+// can be read in a small amount of memory. Each header is checked
+// just like NewReader checks them. Only where the data of each
+// member lies is remembered (to check for overlaps).
+func NewLazyReader(archive_name string, archive io.ReaderAt, size int64) (*Reader, error) {
+	return NewLazyReaderWithLimits(archive_name, archive, size, DefaultLimits)
+}
+
+// Like NewLazyReader but parses the headers with the given limits
+// rather than DefaultLimits.
+func NewLazyReaderWithLimits(archive_name string, archive io.ReaderAt, size int64, limits Limits) (*Reader, error) {
+	reader := &Reader{
+		name:    archive_name,
+		archive: archive,
+		lazy:    true,
+		limits:  limits,
+	}
+	ranges := []data_range{}
+	input := NewHeaderParser(archive_name, io.NewSectionReader(archive, 0, math.MaxInt64), limits)
+	err := input.each_header(func(header Header, offset int64) error {
+		data_start, data_size, err := reader.check_member(header, offset, 0, size)
+		if err == nil && data_size > 0 {
+			ranges = append(ranges, data_range{data_start, data_start + data_size, offset})
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	reader.header_region_size = input.Offset()
+	// No member's data may start before the end of the header
+	// region (which we only know the size of at the end).
+	for _, data := range ranges {
+		if data.start < reader.header_region_size {
+			return nil, reader.error(reader.header_at(data.header_offset), data.start, ErrLayoutOverlap)
+		}
+	}
+	if err := reader.check_overlaps(ranges); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Returns an iterator over the headers of the archive in the order
+// they appear. A lazy Reader parses them from the archive (again for
+// each call) so only one is held in memory at a time. An error (which
+// can only happen for a lazy Reader when the archive changes after it
+// was opened) ends the iteration.
+func (reader *Reader) All() iter.Seq2[Header, error] {
+	return func(yield func(Header, error) bool) {
+		if !reader.lazy {
+			for _, header := range reader.Headers {
+				if !yield(header, nil) {
+					return
+				}
+			}
+			return
+		}
+		if reader.header_region_size == 0 {
+			return
+		}
+		region := io.NewSectionReader(reader.archive, 0, reader.header_region_size)
+		input := NewHeaderParser(reader.name, region, reader.limits)
+		stopped := errors.New("stopped")
+		err := input.each_header(func(header Header, offset int64) error {
+			if !yield(header, nil) {
+				return stopped
+			}
+			return nil
+		})
+		if err != nil && err != stopped {
+			yield(nil, err)
+		}
+	}
+}
+
+// The name this Reader was created with.
+func (reader *Reader) Name() string {
+	return reader.name
+}
+
+// Find the header for a paritcular file. Does not yet handle
+// versioned files. The error wraps ErrMemberNotFound when there is
+// no such member.
+//
+// The first call indexes every member by name so later calls don't
+// have to look through all of the headers (which means changes to
+// Headers after the first call aren't seen). It is safe to call Find
+// from several goroutines. A lazy Reader only keeps the offsets of
+// the headers sorted by name so each later call parses the few
+// headers a binary search looks at.
+func (reader *Reader) Find(filename string) (Header, error) {
+	if reader.lazy {
+		offsets, err := reader.find_offsets(filename, false)
+		if err != nil {
+			return nil, err
+		}
+		if len(offsets) == 0 {
+			return nil, reader.not_found(filename)
+		}
+		return reader.read_header_at(offsets[0])
+	}
+	reader.by_name_built.Do(func() {
+		reader.by_name = make(map[string]int, len(reader.Headers))
+		for i, header := range reader.Headers {
+			name, ok := header[FILE_NAME_KEY]
+			if _, seen := reader.by_name[name]; ok && !seen {
+				reader.by_name[name] = i
+			}
+		}
+	})
+	if i, ok := reader.by_name[filename]; ok {
+		return reader.Headers[i], nil
+	}
+	return nil, reader.not_found(filename)
+}
+
+func (reader *Reader) not_found(filename string) error {
+	return &ArchiveError{
+		Archive: reader.name,
+		Member:  filename,
+		Offset:  -1,
+		Err:     ErrMemberNotFound,
+	}
+}
+
+// Returns a reader over the data of a member of this archive.
+func (reader *Reader) Data(header Header) (*io.SectionReader, error) {
+	start, size, err := header_range(header)
+	if err != nil {
+		return nil, reader.error(header, -1, err)
+	}
+	return io.NewSectionReader(reader.archive, start, size), nil
+}
+
+// Close the underlying archive if it was opened by OpenReader.
+func (reader *Reader) Close() error {
+	if reader.closer == nil {
+		return nil
+	}
+	return reader.closer.Close()
+}
+
+// Where the data of a member lies (and where its header is so that
+// the header doesn't have to be kept around).
+type data_range struct {
+	start         int64
+	end           int64
+	header_offset int64
+}
+
+// Make sure that every member's data lies after the header region,
+// within the archive, and doesn't overlap the data of any other
+// member.
+func (reader *Reader) check_layout(header_region_size int64, archive_size int64) error {
+	ranges := []data_range{}
+	for i, header := range reader.Headers {
+		start, size, err := reader.check_member(header, reader.header_offsets[i], header_region_size, archive_size)
+		if err != nil {
+			return err
+		}
+		if size > 0 {
+			ranges = append(ranges, data_range{start, start + size, reader.header_offsets[i]})
+		}
+	}
+	return reader.check_overlaps(ranges)
+}
+
+// Sort the ranges by where they start and make sure none of them
+// overlap. Members that share exactly the same data are allowed.
+func (reader *Reader) check_overlaps(ranges []data_range) error {
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+	for i := 1; i < len(ranges); i++ {
+		previous, current := ranges[i-1], ranges[i]
+		if previous.start == current.start && previous.end == current.end {
+			continue
+		}
+		if current.start < previous.end {
+			return reader.error(reader.header_at(current.header_offset), current.start, ErrLayoutOverlap)
+		}
+	}
+	return nil
+}
+
+// Returns the header at offset (parsing it again for a lazy Reader)
+// or nil if it can't be found.
+func (reader *Reader) header_at(offset int64) Header {
+	header, _ := reader.read_header_at(offset)
+	return header
+}
+
+// Like header_at but returns why the header can't be found.
+func (reader *Reader) read_header_at(offset int64) (Header, error) {
+	if !reader.lazy {
+		i, found := sort.Find(len(reader.header_offsets), func(i int) int {
+			return cmp.Compare(offset, reader.header_offsets[i])
+		})
+		if !found {
+			return nil, reader.error(nil, offset, ErrMalformedHeader)
+		}
+		return reader.Headers[i], nil
+	}
+	// Most headers are short so there is no need for a big buffer.
+	section := io.NewSectionReader(reader.archive, offset, math.MaxInt64-offset)
+	input := NewHeaderParser(reader.name, bufio.NewReaderSize(section, 4096), reader.limits)
+	header, err := input.ReadHeader()
+	if err == nil && len(header) == 0 {
+		err = reader.error(nil, offset, ErrMalformedHeader)
+	}
+	return header, err
+}
+
+// Check the sizes of a single member (whose header is at
+// header_offset) and that its data lies after the header region and
+// within the archive. Returns the start and size of its data.
+func (reader *Reader) check_member(header Header, header_offset int64, header_region_size int64, archive_size int64) (int64, int64, error) {
+	start, size, err := header_range(header)
+	if err == nil {
+		_, err = header.DataSize()
+	}
+	if err != nil {
+		return 0, 0, reader.error(header, header_offset, err)
+	}
+	if size == 0 {
+		return start, size, nil
+	}
+	if start < header_region_size {
+		return 0, 0, reader.error(header, start, ErrLayoutOverlap)
+	}
+	if archive_size >= 0 && size > archive_size-start {
+		return 0, 0, reader.error(header, archive_size, ErrTruncatedData)
+	}
+	return start, size, nil
+}
+
+func (reader *Reader) error(header Header, offset int64, err error) error {
+	return &ArchiveError{
+		Archive: reader.name,
+		Member:  header[FILE_NAME_KEY],
+		Offset:  offset,
+		Err:     err,
+	}
+}
+
+// Returns the start and size of a member's data.
+func header_range(header Header) (int64, int64, error) {
+	size, err := header.Size()
+	if err != nil {
+		return 0, 0, err
+	}
+	start, err := header.Start()
+	if err != nil {
+		return 0, 0, err
+	}
+	if size > 0 && !header.Has(START_KEY) {
+		return 0, 0, fmt.Errorf("%w: missing %s", ErrBadSize, START_KEY)
+	}
+	if start > math.MaxInt64-size {
+		return 0, 0, fmt.Errorf("%w: data ends past the largest possible offset", ErrBadSize)
+	}
+	return start, size, nil
+}
+
+// Read sequences of NUL terminated strings into a sequence of
+// "header" objects (i.e. map[string]string). Each header stops when
+// we encounter a single terminating zero byte (aka, empty "line")
+// that isn't itself the terminator for a header. While all header
+// sequences end in 0x0, 0x0, this may not be the first such
+// appearance of two zeros in a row (for example, a degenerate
+// filename with two U+0000 characters in a row).
+//
+// This uses DefaultLimits (see HeaderParser for more control).
+func ReadHeaders(archive io.Reader) ([]Header, error) {
+	return NewHeaderParser("", archive, DefaultLimits).ReadHeaders()
+}
+
+// Read a single header using DefaultLimits. Unless archive is a
+// *bufio.Reader, this may consume input past the end of the header
+// (see HeaderParser).
+func ReadHeader(archive io.Reader) (Header, error) {
+	return NewHeaderParser("", archive, DefaultLimits).ReadHeader()
+}
@@ -0,0 +1,247 @@
+package corearchive
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Create a Reader for an archive that can only be read once from
+// start to end (such as a pipe). The name is only used to describe
+// the archive in errors.
+//
+// Member data is read straight from input as long as members are
+// read in the order of their headers (which is the order a Writer
+// lays out their data). The data of members that would already have
+// been passed by the time they are read (because their data is out
+// of order or is shared with an earlier member) is spooled in memory
+// as it goes by, up to Limits.MaxSpoolSize bytes at a time (see
+// PlanReads to only spool what will actually be read). Reading data
+// that has already been passed fails with an error wrapping
+// ErrNotStreamable.
+func NewStreamReader(archive_name string, input io.Reader) (*Reader, error) {
+	return NewStreamReaderWithLimits(archive_name, input, DefaultLimits)
+}
+
+// Like NewStreamReader but parses the headers (and spools data) with
+// the given limits rather than DefaultLimits.
+func NewStreamReaderWithLimits(archive_name string, input io.Reader, limits Limits) (*Reader, error) {
+	// The parser reads exactly the header region from a
+	// *bufio.Reader so the data starts with whatever it leaves
+	// buffered.
+	buffered := bufio.NewReaderSize(input, 64*1024)
+	parser := NewHeaderParser(archive_name, buffered, limits)
+	headers, header_offsets, err := parser.read_headers()
+	if err != nil {
+		return nil, err
+	}
+	stream := &stream{
+		input:     buffered,
+		position:  parser.Offset(),
+		max_spool: limits.MaxSpoolSize,
+	}
+	reader := &Reader{
+		name:           archive_name,
+		archive:        stream,
+		header_offsets: header_offsets,
+		Headers:        headers,
+	}
+	if err := reader.check_layout(parser.Offset(), -1); err != nil {
+		return nil, err
+	}
+	stream.plan(headers, func(Header) bool { return true }, false)
+	return reader, nil
+}
+
+// Tell a Reader created by NewStreamReader which members will have
+// their data read (in the order of their headers) so that only the
+// data those members need out of order is spooled. Without this, the
+// data of every member is expected to be read. With follow_links,
+// reading a hard link means reading the data of the first member
+// before it with its link-target: as the name. It must be called
+// before any member data is read and does nothing for other Readers.
+func (reader *Reader) PlanReads(read func(header Header) bool, follow_links bool) {
+	if stream, ok := reader.archive.(*stream); ok {
+		stream.plan(reader.Headers, read, follow_links)
+	}
+}
+
+// Whether the Reader was created by NewStreamReader (so its member
+// data can't be read by several goroutines at once and has to be read
+// in order).
+func (reader *Reader) IsStream() bool {
+	_, ok := reader.archive.(*stream)
+	return ok
+}
+
+// An io.ReaderAt over input which may only go forward. Only the
+// spools (which never overlap and are sorted by their start) can be
+// read again.
+type stream struct {
+	input    io.Reader
+	position int64
+	spools   []*spool
+	// The number of bytes currently held by all of the spools.
+	spooled   int64
+	max_spool int64
+	scratch   []byte
+}
+
+// The data of one or more members which are read after the stream
+// has passed it.
+type spool struct {
+	start int64
+	end   int64
+	data  []byte
+	// How many more times the whole range will be read.
+	readers int
+}
+
+// Decide which data has to be spooled by pretending to read every
+// member that will be read in the order of the headers (or the member
+// a hard link is a link to). The headers must have already been
+// checked by check_layout.
+func (stream *stream) plan(headers []Header, read func(header Header) bool, follow_links bool) {
+	stream.spools = nil
+	position := stream.position
+	by_range := make(map[[2]int64]*spool)
+	by_name := make(map[string]Header)
+	for _, header := range headers {
+		if follow_links {
+			name, ok := header[FILE_NAME_KEY]
+			if _, seen := by_name[name]; ok && !seen {
+				by_name[name] = header
+			}
+		}
+		if !read(header) {
+			continue
+		}
+		if follow_links && header.FileType() == FILE_TYPE_HARD_LINK {
+			target, ok := by_name[header[LINK_TARGET_KEY]]
+			if !ok {
+				continue
+			}
+			header = target
+		}
+		start, size, _ := header_range(header)
+		if size == 0 {
+			continue
+		}
+		if start >= position {
+			position = start + size
+			continue
+		}
+		key := [2]int64{start, start + size}
+		if existing, ok := by_range[key]; ok {
+			existing.readers++
+			continue
+		}
+		by_range[key] = &spool{start: start, end: start + size, readers: 1}
+		stream.spools = append(stream.spools, by_range[key])
+	}
+	sort.Slice(stream.spools, func(i, j int) bool {
+		return stream.spools[i].start < stream.spools[j].start
+	})
+}
+
+func (stream *stream) ReadAt(buffer []byte, offset int64) (int, error) {
+	n := 0
+	for n < len(buffer) {
+		at := offset + int64(n)
+		if spool := stream.find_spool(at); spool != nil && at < spool.start+int64(len(spool.data)) {
+			copied := copy(buffer[n:], spool.data[at-spool.start:])
+			n += copied
+			if at+int64(copied) == spool.end {
+				stream.release(spool)
+			}
+			continue
+		}
+		if at < stream.position {
+			return n, fmt.Errorf("%w: offset 0x%x was already read", ErrNotStreamable, at)
+		}
+		if err := stream.skip(at); err != nil {
+			return n, err
+		}
+		read, err := stream.read(buffer[n:])
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Returns the spool whose range includes offset (if any).
+func (stream *stream) find_spool(offset int64) *spool {
+	i := sort.Search(len(stream.spools), func(i int) bool {
+		return stream.spools[i].end > offset
+	})
+	if i < len(stream.spools) && stream.spools[i].start <= offset {
+		return stream.spools[i]
+	}
+	return nil
+}
+
+// Forget a spool once every member that needs it has read all of it.
+func (stream *stream) release(spool *spool) {
+	spool.readers--
+	if spool.readers > 0 {
+		return
+	}
+	for i, candidate := range stream.spools {
+		if candidate == spool {
+			stream.spools = append(stream.spools[:i], stream.spools[i+1:]...)
+			break
+		}
+	}
+	stream.spooled -= int64(len(spool.data))
+}
+
+// Read (and throw away unless it needs to be spooled) everything up to
+// offset.
+func (stream *stream) skip(offset int64) error {
+	if stream.scratch == nil {
+		stream.scratch = make([]byte, 64*1024)
+	}
+	for stream.position < offset {
+		size := min(int64(len(stream.scratch)), offset-stream.position)
+		if _, err := stream.read(stream.scratch[:size]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fill buffer from the input (and the spools from what was read).
+func (stream *stream) read(buffer []byte) (int, error) {
+	n, err := io.ReadFull(stream.input, buffer)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("%w: the archive ends at offset 0x%x", ErrTruncatedData, stream.position+int64(n))
+	}
+	if spool_err := stream.keep(stream.position, buffer[:n]); spool_err != nil {
+		err = spool_err
+	}
+	stream.position += int64(n)
+	return n, err
+}
+
+// Add the part of bytes (which are found at offset) that belong to
+// any of the spools to them. Since the input is read in order, each
+// spool is always filled in order too.
+func (stream *stream) keep(offset int64, bytes []byte) error {
+	end := offset + int64(len(bytes))
+	i := sort.Search(len(stream.spools), func(i int) bool {
+		return stream.spools[i].end > offset
+	})
+	for ; i < len(stream.spools) && stream.spools[i].start < end; i++ {
+		spool := stream.spools[i]
+		from, to := max(offset, spool.start), min(end, spool.end)
+		spool.data = append(spool.data, bytes[from-offset:to-offset]...)
+		stream.spooled += to - from
+		if stream.max_spool > 0 && stream.spooled > stream.max_spool {
+			return fmt.Errorf("%w: more than %d bytes of out of order data", ErrNotStreamable, stream.max_spool)
+		}
+	}
+	return nil
+}
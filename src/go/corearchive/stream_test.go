@@ -0,0 +1,71 @@
+package corearchive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// The data of "two" comes before the data of "one" so reading "one"
+// first means "two" has to be spooled (unless it won't be read).
+const OUT_OF_ORDER_ARCHIVE = "file-name:one\x00size:3\x00start:42\x00\x00file-name:two\x00size:3\x00start:3f\x00\x00\x00TWOONE"
+
+func read_one(t *testing.T, plan bool) error {
+	limits := DefaultLimits
+	limits.MaxSpoolSize = 2
+	reader, err := NewStreamReaderWithLimits("stream", bytes.NewReader([]byte(OUT_OF_ORDER_ARCHIVE)), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan {
+		reader.PlanReads(func(header Header) bool {
+			return header[FILE_NAME_KEY] == "one"
+		}, false)
+	}
+	data, err := reader.Data(reader.Headers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := io.ReadAll(data)
+	if err == nil && string(contents) != "ONE" {
+		t.Fatalf("read %q", contents)
+	}
+	return err
+}
+
+func TestStreamPlanReads(t *testing.T) {
+	if err := read_one(t, false); !errors.Is(err, ErrNotStreamable) {
+		t.Fatalf("expected ErrNotStreamable but got %v", err)
+	}
+	if err := read_one(t, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reading the data of a hard link (after reading the member it links
+// to) only works when the link was followed when planning.
+func TestStreamPlanReadsHardLink(t *testing.T) {
+	archive := "file-name:one\x00size:3\x00start:54\x00\x00file-name:link\x00file-type:hard-link\x00link-target:one\x00\x00\x00ONE"
+	for _, follow_links := range []bool{false, true} {
+		reader, err := NewStreamReader("stream", bytes.NewReader([]byte(archive)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.PlanReads(func(Header) bool { return true }, follow_links)
+		for i := range 2 {
+			data, err := reader.Data(reader.Headers[0])
+			if err == nil {
+				_, err = io.ReadAll(data)
+			}
+			switch {
+			case follow_links || i == 0:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case !errors.Is(err, ErrNotStreamable):
+				t.Fatalf("expected ErrNotStreamable but got %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,607 @@
+package corearchive
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// A Writer collects members and then writes a complete archive when
+// it is closed. The data for each member is only read when the
+// archive is written so adding a member is cheap.
+//
+// Since all of the headers come first in an archive, nothing can be
+// written until the size of every member is known. Data written with
+// CreateMember (where the size isn't known up front) is therefore
+// spooled to a temporary file until the Writer is closed.
+type Writer struct {
+	output  io.Writer
+	headers []Header
+	sources []source
+
+	// Lazily created the first time CreateMember is called.
+	spool *os.File
+	// The spool files of the other workers compressing members.
+	worker_spools []*os.File
+	// The member currently being written by CreateMember (if any).
+	current *member_writer
+	closed  bool
+
+	// When not empty, members without a data-hash: get one.
+	hash_algorithm string
+	// When not empty, members that aren't already compressed are
+	// compressed with this algorithm (when that makes them smaller).
+	compression_algorithm string
+	// When greater than one, members with data that don't already
+	// have an align: get this one.
+	alignment int64
+	// How many members may be compressed and hashed at once.
+	jobs int
+}
+
+// This is returned by CreateMember and appends to the spool file.
+type member_writer struct {
+	writer *Writer
+	header Header
+	start  int64
+	size   int64
+	done   bool
+	// Set for members that can't have any data (which therefore
+	// aren't spooled).
+	no_data bool
+	// Only set when we are computing the data-hash: on the fly.
+	digest hash.Hash
+}
+
+// This represents where the data for a member comes from. Only one
+// of filename or data should be set (neither is for members without
+// any data).
+type source struct {
+	filename string
+	data     *io.SectionReader
+}
+
+// Create a Writer that will write an archive to output when Close is
+// called. Closing the Writer does not close output.
+func NewWriter(output io.Writer) *Writer {
+	return &Writer{
+		output: output,
+	}
+}
+
+// Record a data-hash: (computed with the given algorithm, for example
+// "SHA-256") for every member that doesn't already have one. Members
+// added with CreateMember are hashed as they are written and other
+// members are hashed when the Writer is closed.
+func (writer *Writer) SetHashAlgorithm(algorithm string) error {
+	canonical, err := CanonicalHashAlgorithm(algorithm)
+	if err != nil {
+		return err
+	}
+	writer.hash_algorithm = canonical
+	return nil
+}
+
+// Compress the data of every member that isn't already compressed
+// with the given algorithm ("gzip", "zlib" or "flate") unless that
+// doesn't make the data smaller. Compression happens when the Writer
+// is closed (using the spool file) and the size: of a compressed
+// member becomes the compressed size while data-size: records the
+// original size.
+//
+// When hashing too, the data-hash: is always of the stored (so
+// possibly compressed) data.
+func (writer *Writer) SetCompression(algorithm string) error {
+	if _, err := find_compression_algorithm(algorithm); err != nil {
+		return err
+	}
+	writer.compression_algorithm = algorithm
+	return nil
+}
+
+// Make the data of every member that doesn't already have an align:
+// start at a multiple of alignment bytes from the beginning of the
+// archive (which is handy for readers that want to mmap member data).
+// Members with their own align: value keep it.
+func (writer *Writer) SetAlignment(alignment int64) error {
+	if alignment <= 0 {
+		return fmt.Errorf("%w: alignment must be positive", ErrBadSize)
+	}
+	writer.alignment = alignment
+	return nil
+}
+
+// Compress and hash up to jobs members at once when the Writer is
+// closed. The archive is exactly the same as when this is done one
+// member at a time (since the layout is only computed once every
+// member is done) but compressing uses a spool file for each job.
+func (writer *Writer) SetJobs(jobs int) error {
+	if jobs <= 0 {
+		return fmt.Errorf("the number of jobs must be positive (not %d)", jobs)
+	}
+	writer.jobs = jobs
+	return nil
+}
+
+// Add a member whose data is the contents of a file on disk. The
+// header must already contain the size of the file.
+func (writer *Writer) AddFile(header Header, filename string) error {
+	return writer.add(header, source{filename: filename})
+}
+
+// Add a member whose data is read from a section of some other
+// reader, usually the data of a member of another archive (see
+// Reader.Data).
+func (writer *Writer) AddSection(header Header, data *io.SectionReader) error {
+	return writer.add(header, source{data: data})
+}
+
+func (writer *Writer) add(header Header, data source) error {
+	if writer.closed {
+		return ErrWriterClosed
+	}
+	writer.finish_member()
+	writer.headers = append(writer.headers, header)
+	writer.sources = append(writer.sources, data)
+	return nil
+}
+
+// Add a member whose data will be written to the returned
+// io.Writer. The size: of the header is filled in once the data is
+// complete which is when CreateMember is called again or when the
+// Writer is closed (after which the returned io.Writer must not be
+// used). Members whose file-type: can't have any data (directories,
+// links, FIFOs, and devices) aren't spooled and writing any data to
+// them is an error.
+func (writer *Writer) CreateMember(header Header) (io.Writer, error) {
+	if writer.closed {
+		return nil, ErrWriterClosed
+	}
+	writer.finish_member()
+	if !can_have_data(header) {
+		writer.current = &member_writer{writer: writer, header: header, no_data: true}
+		return writer.current, nil
+	}
+	start, err := writer.spool_end()
+	if err != nil {
+		return nil, err
+	}
+	writer.current = &member_writer{
+		writer: writer,
+		header: header,
+		start:  start,
+	}
+	// Compressed members are hashed after they are compressed
+	// (and only regular files are hashed at all).
+	if writer.hash_algorithm != "" && writer.compression_algorithm == "" &&
+		!header.Has(DATA_HASH_KEY) && header.FileType() == FILE_TYPE_REGULAR {
+		writer.current.digest, _ = new_hash(writer.hash_algorithm)
+	}
+	return writer.current, nil
+}
+
+// Returns the offset of the end of the spool file (creating it if
+// needed).
+func (writer *Writer) spool_end() (int64, error) {
+	if writer.spool == nil {
+		spool, err := os.CreateTemp("", "corearchive-spool-*")
+		if err != nil {
+			return 0, err
+		}
+		writer.spool = spool
+	}
+	return writer.spool.Seek(0, io.SeekEnd)
+}
+
+// Whether members of this type may have data (the file-type: values
+// we don't know might).
+func can_have_data(header Header) bool {
+	switch header.FileType() {
+	case FILE_TYPE_DIRECTORY, FILE_TYPE_SYMBOLIC_LINK, FILE_TYPE_HARD_LINK, FILE_TYPE_FIFO,
+		FILE_TYPE_CHARACTER_DEVICE, FILE_TYPE_BLOCK_DEVICE:
+		return false
+	}
+	return true
+}
+
+func (member *member_writer) Write(bytes []byte) (int, error) {
+	if member.done {
+		return 0, ErrWriterClosed
+	}
+	if member.no_data {
+		if len(bytes) > 0 {
+			return 0, fmt.Errorf("%w: a %s can't have any data", ErrBadSize, member.header.FileType())
+		}
+		return 0, nil
+	}
+	n, err := member.writer.spool.Write(bytes)
+	member.size += int64(n)
+	if member.digest != nil {
+		member.digest.Write(bytes[:n])
+	}
+	return n, err
+}
+
+// Record the member currently being written by CreateMember (if
+// any) now that we know its size.
+func (writer *Writer) finish_member() {
+	member := writer.current
+	if member == nil {
+		return
+	}
+	member.done = true
+	member.header[SIZE_KEY] = fmt.Sprintf("%x", member.size)
+	if member.digest != nil {
+		set_hash(member.header, member.writer.hash_algorithm, member.digest)
+	}
+	writer.headers = append(writer.headers, member.header)
+	if member.no_data {
+		writer.sources = append(writer.sources, source{})
+	} else {
+		writer.sources = append(writer.sources, source{
+			data: io.NewSectionReader(writer.spool, member.start, member.size),
+		})
+	}
+	writer.current = nil
+}
+
+// Given the headers (which must include the sizes of all written
+// elements), writes an archive by first laying out the archive, then
+// writing all of the headers, and then finally writing all of the
+// members contents. Any spooled data is then thrown away.
+func (writer *Writer) Close() error {
+	if writer.closed {
+		return ErrWriterClosed
+	}
+	writer.finish_member()
+	writer.closed = true
+	if writer.spool != nil {
+		defer os.Remove(writer.spool.Name())
+		defer writer.spool.Close()
+	}
+	defer func() {
+		for _, spool := range writer.worker_spools {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+	}()
+
+	if writer.compression_algorithm != "" || writer.hash_algorithm != "" {
+		if err := writer.prepare_members(); err != nil {
+			return err
+		}
+	}
+
+	if writer.alignment > 1 {
+		for _, member := range writer.headers {
+			size, _ := member.Size()
+			if size > 0 && !member.Has(ALIGN_KEY) {
+				member[ALIGN_KEY] = fmt.Sprintf("%x", writer.alignment)
+			}
+		}
+	}
+
+	/* First we need to figure out where everything goes */
+	if err := layout_archive(writer.headers); err != nil {
+		return err
+	}
+
+	/* First write all of the headers */
+	offset := int64(0)
+	for _, member := range writer.headers {
+		bytes := member.Bytes()
+		if _, err := writer.output.Write(bytes); err != nil {
+			return err
+		}
+		offset += int64(len(bytes))
+	}
+
+	/* Write and empty header / zero byte to signal the end of headers. */
+	if _, err := writer.output.Write([]byte{0}); err != nil {
+		return err
+	}
+	offset += 1
+
+	/* Now write all of the raw data contents */
+	for j, member := range writer.headers {
+		size, _ := member.Size()
+		if size > 0 {
+			start, _ := member.Start()
+			/* Pad with zeros up to an aligned start. */
+			if err := copy_bytes(writer.output, zeros{}, start-offset); err != nil {
+				return err
+			}
+			if err := copy_source(writer.output, writer.sources[j], size); err != nil {
+				return &ArchiveError{
+					Member: member[FILE_NAME_KEY],
+					Offset: start,
+					Err:    err,
+				}
+			}
+			offset = start + size
+		}
+	}
+	return nil
+}
+
+// An endless source of zero bytes used for padding.
+type zeros struct{}
+
+func (zeros) Read(buffer []byte) (int, error) {
+	clear(buffer)
+	return len(buffer), nil
+}
+
+// Compress and then hash every member on up to writer.jobs
+// workers. Each worker compresses into a spool file of its own (the
+// first one uses the Writer's spool file) and the error of the
+// earliest member that failed is returned so the result doesn't
+// depend on which worker got to which member first.
+func (writer *Writer) prepare_members() error {
+	jobs := max(min(writer.jobs, len(writer.headers)), 1)
+	spools := make([]*os.File, jobs)
+	if writer.compression_algorithm != "" {
+		if _, err := writer.spool_end(); err != nil {
+			return err
+		}
+		spools[0] = writer.spool
+		for i := 1; i < jobs; i++ {
+			spool, err := os.CreateTemp("", "corearchive-spool-*")
+			if err != nil {
+				return err
+			}
+			writer.worker_spools = append(writer.worker_spools, spool)
+			spools[i] = spool
+		}
+	}
+
+	errs := make([]error, len(writer.headers))
+	next := atomic.Int64{}
+	failed := atomic.Bool{}
+	workers := sync.WaitGroup{}
+	for _, spool := range spools {
+		workers.Go(func() {
+			for !failed.Load() {
+				j := int(next.Add(1) - 1)
+				if j >= len(writer.headers) {
+					return
+				}
+				errs[j] = writer.prepare_member(j, spool)
+				if errs[j] != nil {
+					failed.Store(true)
+				}
+			}
+		})
+	}
+	workers.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compress (into spool) and then hash the data of a single member
+// according to the algorithms the Writer was given.
+func (writer *Writer) prepare_member(j int, spool *os.File) error {
+	if writer.compression_algorithm != "" {
+		if err := writer.compress_member(j, spool); err != nil {
+			return err
+		}
+	}
+	if writer.hash_algorithm != "" {
+		return writer.hash_member(j)
+	}
+	return nil
+}
+
+// Compress the data of a member that isn't already compressed into
+// the spool file (and keep the compressed version if it is actually
+// smaller).
+func (writer *Writer) compress_member(j int, spool *os.File) error {
+	member := writer.headers[j]
+	if member.IsCompressed() {
+		return nil
+	}
+	size, err := member.Size()
+	if err != nil {
+		return &ArchiveError{Member: member[FILE_NAME_KEY], Offset: -1, Err: err}
+	}
+	if size == 0 {
+		return nil
+	}
+	start, err := spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	input, err := open_source(writer.sources[j], size)
+	if err != nil {
+		return &ArchiveError{Member: member[FILE_NAME_KEY], Offset: -1, Err: err}
+	}
+	compressed_size, original_size, err := compress(writer.compression_algorithm, spool, input)
+	input.Close()
+	if err == nil && original_size != size {
+		err = fmt.Errorf("%w: expected %d bytes but only read %d", ErrBadSize, size, original_size)
+	}
+	if err != nil {
+		return &ArchiveError{Member: member[FILE_NAME_KEY], Offset: -1, Err: err}
+	}
+	if compressed_size >= size {
+		// Not worth it so just forget what we wrote.
+		return spool.Truncate(start)
+	}
+	member[DATA_COMPRESSION_ALGORITHM_KEY] = writer.compression_algorithm
+	member[DATA_SIZE_KEY] = fmt.Sprintf("%x", size)
+	member[SIZE_KEY] = fmt.Sprintf("%x", compressed_size)
+	// Any data-hash: was of the uncompressed data.
+	delete(member, DATA_HASH_ALGORITHM_KEY)
+	delete(member, DATA_HASH_KEY)
+	writer.sources[j] = source{data: io.NewSectionReader(spool, start, compressed_size)}
+	return nil
+}
+
+// Compute the data-hash: of a member that doesn't have one yet. This
+// means reading the data of the member twice.
+func (writer *Writer) hash_member(j int) error {
+	member := writer.headers[j]
+	// Only the data of regular files is worth hashing.
+	if member.Has(DATA_HASH_KEY) || member.FileType() != FILE_TYPE_REGULAR {
+		return nil
+	}
+	size, err := member.Size()
+	if err != nil {
+		return &ArchiveError{Member: member[FILE_NAME_KEY], Offset: -1, Err: err}
+	}
+	digest, _ := new_hash(writer.hash_algorithm)
+	if err := copy_source(digest, writer.sources[j], size); err != nil {
+		return &ArchiveError{Member: member[FILE_NAME_KEY], Offset: -1, Err: err}
+	}
+	set_hash(member, writer.hash_algorithm, digest)
+	return nil
+}
+
+// Copy the data for a single member from wherever it lives into the
+// output.
+func copy_source(output io.Writer, input source, size int64) error {
+	data, err := open_source(input, size)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	return copy_bytes(output, data, size)
+}
+
+// Returns a reader over (at most size bytes of) the data of a member
+// which must be closed.
+func open_source(input source, size int64) (io.ReadCloser, error) {
+	if input.data != nil {
+		return io.NopCloser(io.NewSectionReader(input.data, 0, size)), nil
+	}
+	file, err := os.Open(input.filename)
+	if err != nil {
+		return nil, err
+	}
+	return &struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, size), file}, nil
+}
+
+// Assign START_KEY values to all members with non-zero size.
+//
+// For every member with non-zero size, we need to set a value for
+// "start:" such that their raw contents don't overlap (or of course
+// overlap with a header) while minimizing wasted space.
+//
+// We don't really know where the first file should start without
+// computing the size of all of the headers and that presents a
+// problem since the start offset itself is technically a variable
+// width quantity. To work around this, every start: value in an
+// archive is left padded to the same number of hexidecimal digits
+// (never less than 8). We guess a width, compute the size of all of
+// the headers, and then the offset where the data of the last member
+// would end. If that offset needs more digits than we guessed, we
+// try again with the wider width. Since a wider width can only make
+// the header region bigger, and there are only 16 hexidecimal digits
+// in an int64, this quickly converges (almost always on the first
+// try). We also need to add one since we always add a blank "header"
+// (a zero byte) according to the specification (this makes is much
+// easier to determine where the last header is).
+//
+// Members with an align: value have their start: rounded up to a
+// multiple of it. The bytes skipped over are zero filled.
+func layout_archive(headers []Header) error {
+	sizes := make([]int64, len(headers))
+	aligns := make([]int64, len(headers))
+	// The size of each header not counting its start: line.
+	header_sizes := make([]int64, len(headers))
+	for i, member := range headers {
+		size, err := member.Size()
+		if err == nil {
+			aligns[i], err = member.Align()
+		}
+		if err != nil {
+			return &ArchiveError{Member: member[FILE_NAME_KEY], Offset: -1, Err: err}
+		}
+		sizes[i] = size
+		delete(member, START_KEY)
+		header_sizes[i] = int64(len(member.Bytes()))
+	}
+
+	width := 8
+	for {
+		end, err := assign_starts(headers, sizes, aligns, header_sizes, width)
+		if err != nil {
+			return err
+		}
+		needed := len(fmt.Sprintf("%x", end))
+		if needed <= width {
+			return nil
+		}
+		width = needed
+	}
+}
+
+// Assign start: values assuming they are all width digits wide and
+// return the offset just past the data of the last member.
+func assign_starts(headers []Header, sizes []int64, aligns []int64, header_sizes []int64, width int) (int64, error) {
+	start_line_size := int64(len(START_KEY) + width + 1)
+	header_size := int64(0)
+	for i := range headers {
+		header_size += header_sizes[i]
+		if sizes[i] > 0 {
+			header_size += start_line_size
+		}
+	}
+	// We always write an extra 0 byte after the headers (which
+	// reads as an empty header) and this tells a reader where the
+	// end of the headers is.
+	header_size += 1
+	start := header_size
+	for i, member := range headers {
+		if sizes[i] > 0 {
+			if remainder := start % aligns[i]; remainder != 0 {
+				start += aligns[i] - remainder
+			}
+			if start < 0 || start > math.MaxInt64-sizes[i] {
+				return 0, &ArchiveError{
+					Member: member[FILE_NAME_KEY],
+					Offset: start,
+					Err:    fmt.Errorf("%w: archive would be larger than the largest possible offset", ErrBadSize),
+				}
+			}
+			member[START_KEY] = fmt.Sprintf("%0*x", width, start)
+			start += sizes[i]
+		}
+	}
+	return start, nil
+}
+
+// Copy num_bytes from an input to an output as efficiently as
+// possbile. If the input has fewer bytes than expected (say a file
+// shrank after we looked at its size), the error wraps ErrBadSize.
+func copy_bytes(output io.Writer, input io.Reader, num_bytes int64) error {
+	buffer := make([]byte, BUFFER_SIZE)
+	for num_bytes > 0 {
+		if num_bytes < int64(BUFFER_SIZE) {
+			buffer = buffer[:num_bytes]
+		}
+		n, err := input.Read(buffer)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("%w: ran out of data with %d bytes left to copy", ErrBadSize, num_bytes)
+		}
+		if _, err := output.Write(buffer[:n]); err != nil {
+			return err
+		}
+		num_bytes -= int64(n)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package corearchive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Members of unknown size are spooled until the Writer is closed and
+// must come back out exactly as they were written (however the Writer
+// was told to hash and compress them).
+func TestCreateMember(t *testing.T) {
+	contents := map[string]string{
+		"one.txt":   "a line that is too short to be worth compressing\n",
+		"two.txt":   strings.Repeat("a line that compresses very well\n", 500),
+		"empty.txt": "",
+	}
+	names := []string{"one.txt", "two.txt", "empty.txt"}
+	for _, options := range []struct {
+		name        string
+		hash        string
+		compression string
+	}{
+		{"plain", "", ""},
+		{"hashed", "SHA-256", ""},
+		{"compressed", "", "zlib"},
+		{"hashed and compressed", "SHA-256", "gzip"},
+	} {
+		t.Run(options.name, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			writer := NewWriter(output)
+			if options.hash != "" {
+				if err := writer.SetHashAlgorithm(options.hash); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if options.compression != "" {
+				if err := writer.SetCompression(options.compression); err != nil {
+					t.Fatal(err)
+				}
+			}
+			members := []io.Writer{}
+			for _, name := range names {
+				member, err := writer.CreateMember(Header{FILE_NAME_KEY: name})
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Write in a few pieces.
+				data := contents[name]
+				for len(data) > 0 {
+					piece := data[:min(len(data), 100)]
+					if _, err := io.WriteString(member, piece); err != nil {
+						t.Fatal(err)
+					}
+					data = data[len(piece):]
+				}
+				members = append(members, member)
+			}
+			// Creating another member finishes the previous one.
+			if _, err := members[0].Write([]byte("late")); !errors.Is(err, ErrWriterClosed) {
+				t.Fatalf("writing to a finished member: %v", err)
+			}
+			spool := writer.spool.Name()
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(spool); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("the spool file %s is still there: %v", spool, err)
+			}
+			if _, err := members[len(members)-1].Write([]byte("late")); !errors.Is(err, ErrWriterClosed) {
+				t.Fatalf("writing after Close: %v", err)
+			}
+			if _, err := writer.CreateMember(Header{FILE_NAME_KEY: "late.txt"}); !errors.Is(err, ErrWriterClosed) {
+				t.Fatalf("creating a member after Close: %v", err)
+			}
+			if err := writer.AddFile(Header{FILE_NAME_KEY: "late.txt", SIZE_KEY: "0"}, "late.txt"); !errors.Is(err, ErrWriterClosed) {
+				t.Fatalf("adding a file after Close: %v", err)
+			}
+			if err := writer.AddSection(Header{FILE_NAME_KEY: "late.txt", SIZE_KEY: "0"}, io.NewSectionReader(strings.NewReader(""), 0, 0)); !errors.Is(err, ErrWriterClosed) {
+				t.Fatalf("adding a section after Close: %v", err)
+			}
+
+			reader, err := NewReader("writer-test", bytes.NewReader(output.Bytes()), int64(output.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(reader.Headers) != len(names) {
+				t.Fatalf("read %d members instead of %d", len(reader.Headers), len(names))
+			}
+			for i, header := range reader.Headers {
+				name := names[i]
+				if header[FILE_NAME_KEY] != name {
+					t.Fatalf("member %d is %q instead of %q", i, header[FILE_NAME_KEY], name)
+				}
+				data, err := reader.Open(header)
+				if err != nil {
+					t.Fatal(err)
+				}
+				read, err := io.ReadAll(data)
+				data.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(read) != contents[name] {
+					t.Fatalf("%s has %d bytes of the wrong data", name, len(read))
+				}
+				if header.Has(DATA_HASH_KEY) != (options.hash != "") {
+					t.Fatalf("%s has the wrong hash: %v", name, header)
+				}
+				if err := reader.Verify(header); err != nil {
+					t.Fatal(err)
+				}
+				if compressed := options.compression != "" && name == "two.txt"; header.IsCompressed() != compressed {
+					t.Fatalf("%s should be compressed: %v (%v)", name, compressed, header)
+				}
+			}
+		})
+	}
+}
+
+// Members that can't have any data don't need a spool file.
+func TestCreateMemberWithoutData(t *testing.T) {
+	output := &bytes.Buffer{}
+	writer := NewWriter(output)
+	for _, header := range []Header{
+		{FILE_NAME_KEY: "dir", FILE_TYPE_KEY: FILE_TYPE_DIRECTORY},
+		{FILE_NAME_KEY: "link", FILE_TYPE_KEY: FILE_TYPE_SYMBOLIC_LINK, LINK_TARGET_KEY: "dir"},
+	} {
+		member, err := writer.CreateMember(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := member.Write(nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := member.Write([]byte("data")); !errors.Is(err, ErrBadSize) {
+			t.Fatalf("writing data to a %s: %v", header.FileType(), err)
+		}
+	}
+	if writer.spool != nil {
+		t.Fatalf("created the spool file %s", writer.spool.Name())
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewReader("writer-test", bytes.NewReader(output.Bytes()), int64(output.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, header := range reader.Headers {
+		if header[SIZE_KEY] != "0" {
+			t.Fatalf("%s has data: %v", header[FILE_NAME_KEY], header)
+		}
+	}
+}
+
+// Check that layout_archive gave every member with data a start: of
+// the same width that is after the header region and doesn't overlap
+// any other member. Returns the width.
+func check_starts(t *testing.T, headers []Header) int {
+	t.Helper()
+	if err := layout_archive(headers); err != nil {
+		t.Fatal(err)
+	}
+	header_region_size := int64(1)
+	for _, header := range headers {
+		header_region_size += int64(len(header.Bytes()))
+	}
+	width := 0
+	end := header_region_size
+	for _, header := range headers {
+		size, err := header.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size == 0 {
+			if header.Has(START_KEY) {
+				t.Fatalf("%s has no data but has a start: %v", header[FILE_NAME_KEY], header)
+			}
+			continue
+		}
+		if width == 0 {
+			width = len(header[START_KEY])
+		}
+		if len(header[START_KEY]) != width {
+			t.Fatalf("%s has start:%s instead of %d digits", header[FILE_NAME_KEY], header[START_KEY], width)
+		}
+		start, err := header.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Members are laid out in order.
+		if start < end {
+			t.Fatalf("%s starts at 0x%x before 0x%x", header[FILE_NAME_KEY], start, end)
+		}
+		end = start + size
+	}
+	return width
+}
+
+// Archives (and members) bigger than 4GiB need start: values wider
+// than 8 digits.
+func TestLayoutBigMembers(t *testing.T) {
+	headers := []Header{
+		{FILE_NAME_KEY: "small", SIZE_KEY: "10"},
+		{FILE_NAME_KEY: "huge", SIZE_KEY: "100000005"},
+		{FILE_NAME_KEY: "empty", SIZE_KEY: "0"},
+		{FILE_NAME_KEY: "bigger", SIZE_KEY: "300000000"},
+		{FILE_NAME_KEY: "last", SIZE_KEY: "1"},
+	}
+	if width := check_starts(t, headers); width != 9 {
+		t.Fatalf("start: values are %d digits instead of 9", width)
+	}
+}
+
+// The extra digit a wider start: needs can itself push the end of the
+// archive past what the narrower width could hold.
+func TestLayoutWidthBoundary(t *testing.T) {
+	new_headers := func(size int64) []Header {
+		return []Header{
+			{FILE_NAME_KEY: "first", SIZE_KEY: "1"},
+			{FILE_NAME_KEY: "second", SIZE_KEY: fmt.Sprintf("%x", size)},
+		}
+	}
+	// The size of the header region with 8 digit start: values
+	// (every size below has 8 digits too).
+	header_region_size := int64(1)
+	for _, header := range new_headers(0xf0000000) {
+		header_region_size += int64(len(header.Bytes()) + len(START_KEY) + 8 + 1)
+	}
+	for _, test := range []struct {
+		// How far the end of the data is from 0x100000000
+		// with 8 digit start: values.
+		end   int64
+		width int
+	}{{-1, 8}, {0, 9}, {1, 9}} {
+		size := 0x100000000 + test.end - header_region_size - 1
+		if width := check_starts(t, new_headers(size)); width != test.width {
+			t.Fatalf("ending at 0x100000000%+d needs %d digits but got %d", test.end, test.width, width)
+		}
+	}
+}
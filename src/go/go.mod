@@ -0,0 +1,3 @@
+module github.com/jasonaaronwilson/omni-archive/src/go
+
+go 1.25